@@ -6,11 +6,16 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
+	"hitalent/internal/blob"
 	"hitalent/internal/chat"
 	"hitalent/internal/httpapi"
+	"hitalent/internal/realtime"
 	"hitalent/internal/storage"
+	"hitalent/internal/thumbnail"
+	"hitalent/internal/unfurl"
 )
 
 func main() {
@@ -31,17 +36,112 @@ func main() {
 	defer func() { _ = sqlDB.Close() }()
 	log.Info("connected to postgres")
 
+	// Хаб раздает события чатов живым подписчикам (WebSocket), буфер на подписчика 64 события
+	hub := realtime.NewHub(64)
+
+	// Онлайн и "печатает" держим в памяти процесса, в базу не пишем. Истекшие записи чистим раз в минуту
+	presence := realtime.NewPresence()
+	go presence.Sweep(ctx, time.Minute)
+
+	// Новые сообщения рассылаем другим репликам через pg_notify, а их события слушаем на отдельном соединении
+	notifier := storage.NewPGNotifier(storage.DSN(), log)
+
+	// Предел закрепленных сообщений в чате, по умолчанию chat.DefaultPinLimit
+	pinLimit := chat.DefaultPinLimit
+	if v := os.Getenv("PIN_LIMIT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Error("invalid PIN_LIMIT", "value", v)
+			os.Exit(1)
+		}
+		pinLimit = n
+	}
+
+	// Вложения храним в S3-совместимом хранилище, если задан S3_ENDPOINT, иначе в каталоге BLOB_DIR
+	blobs, err := openBlobStore()
+	if err != nil {
+		log.Error("failed to open blob store", "err", err)
+		os.Exit(1)
+	}
+
+	// Предел размера вложения, по умолчанию chat.DefaultAttachmentMaxBytes
+	attachmentMax := chat.DefaultAttachmentMaxBytes
+	if v := os.Getenv("ATTACHMENT_MAX_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			log.Error("invalid ATTACHMENT_MAX_BYTES", "value", v)
+			os.Exit(1)
+		}
+		attachmentMax = n
+	}
+
 	// Собираем зависимости (repo  service  api  router)
-	repo := chat.NewRepo(gdb)
-	svc := chat.NewService(repo)
+	repo := chat.NewRepo(gdb, chat.WithTxNotifier(notifier))
+	svc := chat.NewService(repo,
+		chat.WithBroker(hub),
+		chat.WithPinLimit(pinLimit),
+		chat.WithPresence(presence),
+		chat.WithBlobStore(blobs),
+		chat.WithAttachmentMaxBytes(attachmentMax),
+		chat.WithThumbnailer(thumbnail.New(thumbnail.DefaultMaxSide)),
+		// превью ссылок: таймаут, предел размера страницы и кеш по URL по умолчанию, внутренние адреса запрещены
+		chat.WithUnfurler(unfurl.New(unfurl.Config{})),
+	)
+
+	// Превью картинок делают фоновые воркеры, по умолчанию 2
+	thumbWorkers := 2
+	if v := os.Getenv("THUMBNAIL_WORKERS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Error("invalid THUMBNAIL_WORKERS", "value", v)
+			os.Exit(1)
+		}
+		thumbWorkers = n
+	}
+	go svc.RunThumbnailWorkers(ctx, thumbWorkers, log)
+
+	// Превью ссылок из новых сообщений строят два фоновых воркера
+	go svc.RunUnfurlWorkers(ctx, 2, log)
+
+	// события других реплик отдаем своим подписчикам
+	go notifier.Listen(ctx, func(ctx context.Context, ev chat.Event) {
+		if err := svc.Relay(ctx, ev); err != nil {
+			log.Warn("relay event", "type", ev.Type, "chat_id", ev.ChatID, "err", err)
+		}
+	})
 	api := httpapi.NewAPI(svc)
 
 	router := httpapi.NewRouter(api)
 
+	// Ключи для проверки JWT читаем из окружения
+	verifier, err := httpapi.LoadTokenVerifier()
+	if err != nil {
+		log.Error("failed to load jwt keys", "err", err)
+		os.Exit(1)
+	}
+
+	// Ключи идемпотентности живут сутки, истекшие чистим раз в час.
+	// Там же удаляем вложения, которые за сутки так и не отправили с сообщением
+	idem := storage.NewIdempotencyStore(gdb)
+	go func() {
+		for range time.Tick(time.Hour) {
+			if _, err := idem.PurgeExpired(ctx); err != nil {
+				log.Warn("purge idempotency keys", "err", err)
+			}
+			if _, err := svc.PurgePendingAttachments(ctx, 24*time.Hour); err != nil {
+				log.Warn("purge pending attachments", "err", err)
+			}
+		}
+	}()
+
 	// Middleware
 	// RecoverMiddleware ловит панику внутри обработчиков
+	// IdempotencyMiddleware повторяет сохраненный ответ на создание чата или сообщения с тем же Idempotency-Key
+	// AuthMiddleware проверяет bearer токен и кладет пользователя в контекст
 	//LoggingMiddleware логирует каждый запрос:
 	handler := httpapi.RecoverMiddleware(log, router)
+	handler = httpapi.IdempotencyMiddleware(idem, 24*time.Hour, handler)
+	handler = httpapi.AuthMiddleware(verifier, handler)
 	handler = httpapi.LoggingMiddleware(log, handler)
 
 	// HTTP server
@@ -50,6 +150,7 @@ func main() {
 		port = "8080"
 	}
 
+	// WriteTimeout общий, long-poll, SSE и WebSocket сами продлевают дедлайн записи для своих запросов
 	srv := &http.Server{
 		Addr:              ":" + port,
 		Handler:           handler,
@@ -65,3 +166,22 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// openBlobStore хранилище вложений из окружения: S3_ENDPOINT, S3_REGION, S3_BUCKET, S3_ACCESS_KEY, S3_SECRET_KEY
+// или каталог BLOB_DIR (по умолчанию data/blobs)
+func openBlobStore() (chat.BlobStore, error) {
+	if endpoint := os.Getenv("S3_ENDPOINT"); endpoint != "" {
+		return blob.NewS3(blob.S3Config{
+			Endpoint:  endpoint,
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+		})
+	}
+	dir := os.Getenv("BLOB_DIR")
+	if dir == "" {
+		dir = "data/blobs"
+	}
+	return blob.NewFS(dir)
+}
@@ -0,0 +1,65 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Role роль участника чата
+type Role string
+
+const (
+	RoleOwner    Role = "owner"     // все, включая удаление чата и назначение владельцев
+	RoleAdmin    Role = "admin"     // управление участниками, заголовком и чужими сообщениями
+	RoleMember   Role = "member"    // читает и пишет
+	RoleReadOnly Role = "read-only" // только читает
+)
+
+// rank уровень роли, чем больше, тем больше прав. Неизвестная роль ниже всех
+func (r Role) rank() int {
+	switch r {
+	case RoleOwner:
+		return 4
+	case RoleAdmin:
+		return 3
+	case RoleMember:
+		return 2
+	case RoleReadOnly:
+		return 1
+	}
+	return 0
+}
+
+// ParseRole проверяем роль из запроса
+func ParseRole(s string) (Role, error) {
+	r := Role(s)
+	if r.rank() == 0 {
+		return "", fmt.Errorf("%w: role must be one of owner, admin, member, read-only", ErrValidation)
+	}
+	return r, nil
+}
+
+// authorize проверяем, что вызывающий состоит в чате с ролью не ниже min, и возвращаем его членство.
+// Для несуществующего чата ErrNotFound, для чужого чата или слабой роли ErrForbidden
+func (s *Service) authorize(ctx context.Context, chatID int64, min Role) (*Member, error) {
+	userID, err := callerID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m, err := s.repo.GetMember(ctx, chatID, userID)
+	if errors.Is(err, ErrNotFound) {
+		// не участник: отличаем несуществующий чат от чужого
+		if _, err := s.repo.GetChatByID(ctx, chatID); err != nil {
+			return nil, err
+		}
+		return nil, ErrForbidden
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.Role.rank() < min.rank() {
+		return nil, ErrForbidden
+	}
+	return m, nil
+}
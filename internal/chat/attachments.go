@@ -0,0 +1,272 @@
+package chat
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// DefaultAttachmentMaxBytes предел размера одного вложения по умолчанию
+const DefaultAttachmentMaxBytes int64 = 25 << 20
+
+// MaxMessageAttachments сколько вложений можно прикрепить к одному сообщению
+const MaxMessageAttachments = 10
+
+// BlobStore хранилище содержимого вложений. Ключи выдает сервис, вида chats/{chatID}/{random}
+type BlobStore interface {
+	// Put сохраняем size байт из r под ключом key
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get открываем содержимое на чтение, для несуществующего ключа ErrNotFound
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete удаляем содержимое, отсутствие ключа не ошибка
+	Delete(ctx context.Context, key string) error
+}
+
+// WithBlobStore включаем вложения, файлы сохраняются в bs
+func WithBlobStore(bs BlobStore) Option {
+	return func(s *Service) {
+		s.blobs = bs
+	}
+}
+
+// WithAttachmentMaxBytes меняем предел размера одного вложения, по умолчанию DefaultAttachmentMaxBytes
+func WithAttachmentMaxBytes(n int64) Option {
+	return func(s *Service) {
+		s.attachmentMax = n
+	}
+}
+
+// UploadAttachment читаем файл из body и сохраняем в BlobStore, возвращаем еще не привязанное вложение.
+// Тело сначала пишем во временный файл: так размер проверяется до записи в хранилище, а тип определяется по содержимому,
+// заявленному клиентом Content-Type не доверяем
+func (s *Service) UploadAttachment(ctx context.Context, chatID int64, filename string, body io.Reader) (*Attachment, error) {
+	if s.blobs == nil {
+		return nil, errors.New("attachments are not configured")
+	}
+	filename = NormalizeFilename(filename)
+	if err := ValidateFilename(filename); err != nil {
+		return nil, err
+	}
+	member, err := s.authorize(ctx, chatID, RoleMember)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp("", "attachment-*")
+	if err != nil {
+		return nil, fmt.Errorf("create temp file: %w", err)
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+
+	// читаем на байт больше предела, чтобы отличить файл ровно на пределе от слишком большого
+	size, err := io.Copy(tmp, io.LimitReader(body, s.attachmentMax+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: read upload: %v", ErrValidation, err)
+	}
+	if size > s.attachmentMax {
+		return nil, fmt.Errorf("%w: attachment must be at most %d bytes", ErrTooLarge, s.attachmentMax)
+	}
+	if size == 0 {
+		return nil, fmt.Errorf("%w: attachment is empty", ErrValidation)
+	}
+
+	// DetectContentType смотрит не дальше первых 512 байт
+	head := make([]byte, 512)
+	n, err := tmp.ReadAt(head, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("read temp file: %w", err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("seek temp file: %w", err)
+	}
+
+	key, err := newStorageKey(chatID)
+	if err != nil {
+		return nil, err
+	}
+	a := &Attachment{
+		ChatID:      chatID,
+		UploaderID:  member.UserID,
+		Filename:    filename,
+		ContentType: http.DetectContentType(head[:n]),
+		Size:        size,
+		StorageKey:  key,
+	}
+	if s.needsThumbnail(a.ContentType) {
+		a.ThumbnailState = ThumbnailProcessing
+	}
+	if err := s.blobs.Put(ctx, key, tmp, size, a.ContentType); err != nil {
+		return nil, fmt.Errorf("put blob: %w", err)
+	}
+	if err := s.repo.CreateAttachment(ctx, a); err != nil {
+		// строки нет, файл никто не найдет, убираем его сразу
+		_ = s.blobs.Delete(context.WithoutCancel(ctx), key)
+		return nil, err
+	}
+	if a.ThumbnailState == ThumbnailProcessing {
+		s.enqueueThumbnail(a.ID)
+	}
+	setAttachmentURLs(a)
+	return a, nil
+}
+
+// OpenAttachment вложение и его содержимое, ридер закрывает вызывающий
+func (s *Service) OpenAttachment(ctx context.Context, chatID, attID int64) (*Attachment, io.ReadCloser, error) {
+	a, err := s.visibleAttachment(ctx, chatID, attID)
+	if err != nil {
+		return nil, nil, err
+	}
+	rc, err := s.blobs.Get(ctx, a.StorageKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return a, rc, nil
+}
+
+// visibleAttachment вложение, если вызывающий может его видеть.
+// Непривязанное вложение доступно только загрузившему, вложение удаленного сообщения никому
+func (s *Service) visibleAttachment(ctx context.Context, chatID, attID int64) (*Attachment, error) {
+	if s.blobs == nil {
+		return nil, ErrNotFound
+	}
+	member, err := s.authorize(ctx, chatID, RoleReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	a, err := s.repo.GetAttachment(ctx, chatID, attID)
+	if err != nil {
+		return nil, err
+	}
+	if a.MessageID == nil {
+		if a.UploaderID != member.UserID {
+			return nil, ErrNotFound
+		}
+	} else {
+		m, err := s.repo.GetMessage(ctx, chatID, *a.MessageID)
+		if err != nil {
+			return nil, err
+		}
+		if m.DeletedAt != nil {
+			return nil, ErrNotFound
+		}
+	}
+	return a, nil
+}
+
+// PurgePendingAttachments удаляем вложения, которые так и не прикрепили к сообщению за olderThan, вместе с файлами
+func (s *Service) PurgePendingAttachments(ctx context.Context, olderThan time.Duration) (int, error) {
+	if s.blobs == nil {
+		return 0, nil
+	}
+	removed, err := s.repo.DeletePendingAttachments(ctx, time.Now().Add(-olderThan))
+	if err != nil {
+		return 0, err
+	}
+	if err := s.deleteBlobs(ctx, removed); err != nil {
+		return 0, err
+	}
+	return len(removed), nil
+}
+
+// deleteBlobs удаляем из хранилища файлы и превью уже удаленных из базы вложений.
+// Ошибка по одному ключу не останавливает удаление остальных, возвращаем первую
+func (s *Service) deleteBlobs(ctx context.Context, removed []Attachment) error {
+	if s.blobs == nil {
+		return nil
+	}
+	var first error
+	for _, a := range removed {
+		for _, key := range []string{a.StorageKey, a.ThumbnailKey} {
+			if key == "" {
+				continue
+			}
+			if err := s.blobs.Delete(ctx, key); err != nil && first == nil {
+				first = fmt.Errorf("delete blob %s: %w", key, err)
+			}
+		}
+	}
+	return first
+}
+
+// checkAttachments проверяем список вложений нового сообщения, повторы убираем.
+// Что вложения свои, из этого чата и еще не привязаны, проверяет репозиторий при привязке
+func (s *Service) checkAttachments(ids []int64) ([]int64, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	if s.blobs == nil {
+		return nil, fmt.Errorf("%w: attachments are not supported", ErrValidation)
+	}
+	seen := make(map[int64]bool, len(ids))
+	out := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		if id <= 0 {
+			return nil, fmt.Errorf("%w: invalid attachment id", ErrValidation)
+		}
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	if len(out) > MaxMessageAttachments {
+		return nil, fmt.Errorf("%w: at most %d attachments per message", ErrValidation, MaxMessageAttachments)
+	}
+	return out, nil
+}
+
+// attachAttachments подгружаем вложения всей страницы одним запросом, у удаленных сообщений их не показываем.
+// Пока у какого-то вложения готовится превью, у сообщения состояние processing
+func (s *Service) attachAttachments(ctx context.Context, msgs []Message) error {
+	ids := make([]int64, 0, len(msgs))
+	for _, m := range msgs {
+		if m.DeletedAt == nil {
+			ids = append(ids, m.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	byMsg, err := s.repo.ListAttachments(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for i := range msgs {
+		if msgs[i].DeletedAt == nil {
+			msgs[i].Attachments = byMsg[msgs[i].ID]
+		}
+		msgs[i].State = ""
+		for _, a := range msgs[i].Attachments {
+			if a.ThumbnailState == ThumbnailProcessing {
+				msgs[i].State = MessageProcessing
+			}
+		}
+	}
+	return nil
+}
+
+// setAttachmentURLs пути скачивания вложения и его готового превью
+func setAttachmentURLs(a *Attachment) {
+	a.URL = fmt.Sprintf("/chats/%d/attachments/%d", a.ChatID, a.ID)
+	a.ThumbnailURL = ""
+	if a.ThumbnailState == ThumbnailReady {
+		a.ThumbnailURL = a.URL + "/thumbnail"
+	}
+}
+
+// newStorageKey случайный ключ файла, по нему нельзя угадать соседние вложения
+func newStorageKey(chatID int64) (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("storage key: %w", err)
+	}
+	return fmt.Sprintf("chats/%d/%s", chatID, hex.EncodeToString(b[:])), nil
+}
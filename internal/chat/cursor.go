@@ -0,0 +1,109 @@
+package chat
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Вид курсора пишем в его начало: курсор одного списка, переданный в другой, это ErrValidation, а не чужая страница
+const (
+	cursorMessages = "m"
+	cursorChats    = "c"
+	cursorSearch   = "s"
+)
+
+// encodeTagged кодируем тело курсора вместе с его видом в непрозрачную для клиента строку
+func encodeTagged(kind, raw string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(kind + "|" + raw))
+}
+
+// decodeTagged достаем тело курсора, если он того же вида
+func decodeTagged(kind, s string) (string, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return "", false
+	}
+	tag, body, ok := strings.Cut(string(raw), "|")
+	if !ok || tag != kind {
+		return "", false
+	}
+	return body, true
+}
+
+// cursor позиция в списке, порядок задается парой (время, id): сообщение в истории чата (created_at)
+// или чат в GET /chats (created_at или последняя активность)
+type cursor struct {
+	CreatedAt time.Time
+	ID        int64
+}
+
+// cursorOf строим курсор по сообщению
+func cursorOf(m Message) cursor {
+	return cursor{CreatedAt: m.CreatedAt, ID: m.ID}
+}
+
+// encodeCursor кодируем курсор вида kind в непрозрачную для клиента строку
+// postgres хранит время с точностью до микросекунд, поэтому храним unix micro
+func encodeCursor(kind string, c cursor) string {
+	return encodeTagged(kind, strconv.FormatInt(c.CreatedAt.UnixMicro(), 10)+":"+strconv.FormatInt(c.ID, 10))
+}
+
+// decodeCursor разбираем курсор вида kind от клиента, любая ошибка это ErrValidation
+func decodeCursor(kind, s string) (cursor, error) {
+	invalid := fmt.Errorf("%w: invalid cursor", ErrValidation)
+
+	raw, ok := decodeTagged(kind, s)
+	if !ok {
+		return cursor{}, invalid
+	}
+	ts, id, ok := strings.Cut(raw, ":")
+	if !ok {
+		return cursor{}, invalid
+	}
+	micro, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return cursor{}, invalid
+	}
+	rowID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || rowID <= 0 {
+		return cursor{}, invalid
+	}
+	return cursor{CreatedAt: time.UnixMicro(micro).UTC(), ID: rowID}, nil
+}
+
+// searchCursor позиция в выдаче поиска, порядок задается парой (rank, id) по убыванию
+type searchCursor struct {
+	Rank float32
+	ID   int64
+}
+
+// encodeSearchCursor кодируем курсор поиска, rank в виде, который без потерь читается обратно во float32
+func encodeSearchCursor(c searchCursor) string {
+	return encodeTagged(cursorSearch, strconv.FormatFloat(float64(c.Rank), 'g', -1, 32)+":"+strconv.FormatInt(c.ID, 10))
+}
+
+// decodeSearchCursor разбираем курсор поиска от клиента, любая ошибка это ErrValidation
+func decodeSearchCursor(s string) (searchCursor, error) {
+	invalid := fmt.Errorf("%w: invalid cursor", ErrValidation)
+
+	raw, ok := decodeTagged(cursorSearch, s)
+	if !ok {
+		return searchCursor{}, invalid
+	}
+	rank, id, ok := strings.Cut(raw, ":")
+	if !ok {
+		return searchCursor{}, invalid
+	}
+	r, err := strconv.ParseFloat(rank, 32)
+	if err != nil {
+		return searchCursor{}, invalid
+	}
+	msgID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || msgID <= 0 {
+		return searchCursor{}, invalid
+	}
+	return searchCursor{Rank: float32(r), ID: msgID}, nil
+}
@@ -7,3 +7,18 @@ var ErrNotFound = errors.New("not found")
 
 // ErrValidation используем для ошибок валидации входных данных (title/text/limit).
 var ErrValidation = errors.New("validation error")
+
+// ErrPreconditionFailed используем, когда версия из If-Match не совпала с текущей (чат уже изменили).
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// ErrUnauthenticated используем, когда в контексте нет пользователя, который делает запрос.
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// ErrForbidden используем, когда пользователю не хватает прав (не участник чата или слабая роль).
+var ErrForbidden = errors.New("forbidden")
+
+// ErrConflict используем, когда операция противоречит текущему состоянию (например, удалить последнего владельца).
+var ErrConflict = errors.New("conflict")
+
+// ErrTooLarge используем, когда загружаемые данные больше допустимого размера (например, вложение).
+var ErrTooLarge = errors.New("too large")
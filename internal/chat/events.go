@@ -0,0 +1,99 @@
+package chat
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+)
+
+// Типы событий чата для живых подписчиков
+const (
+	EventMessageCreated = "message.created"
+	EventMessageUpdated = "message.updated"
+	EventMessageDeleted = "message.deleted"
+	EventChatDeleted    = "chat.deleted"
+	EventTyping         = "user.typing"
+	EventMemberRemoved  = "member.removed"
+)
+
+// Event событие в чате. Message есть у created/updated, у message.deleted только MessageID,
+// у user.typing и member.removed только UserID
+type Event struct {
+	Type      string   `json:"type"`
+	ChatID    int64    `json:"chat_id"`
+	MessageID int64    `json:"message_id,omitempty"`
+	UserID    int64    `json:"user_id,omitempty"`
+	Message   *Message `json:"message,omitempty"`
+}
+
+// Broker доставляет события подписчикам чата
+type Broker interface {
+	Publish(ev Event)
+	Subscribe(chatID int64) Subscription
+}
+
+// Subscription подписка на события одного чата
+type Subscription interface {
+	// Events канал событий, закрывается после Close или когда подписчик не успевает читать
+	Events() <-chan Event
+	Close()
+}
+
+// TxNotifier рассылает событие другим репликам API в рамках транзакции записи,
+// поэтому они узнают о нем только после коммита и только если коммит прошел
+type TxNotifier interface {
+	NotifyTx(tx *gorm.DB, ev Event) error
+}
+
+// RepoOption настройка Repo
+type RepoOption func(*Repo)
+
+// WithTxNotifier включаем рассылку событий чатов другим репликам из транзакций записи Repo
+func WithTxNotifier(n TxNotifier) RepoOption {
+	return func(r *Repo) {
+		r.notifier = n
+	}
+}
+
+// Option настройка Service
+type Option func(*Service)
+
+// WithBroker включаем доставку событий живым подписчикам
+func WithBroker(b Broker) Option {
+	return func(s *Service) {
+		s.broker = b
+	}
+}
+
+// publish отправляем событие, если брокер настроен
+func (s *Service) publish(ev Event) {
+	if s.broker != nil {
+		s.broker.Publish(ev)
+	}
+}
+
+// Relay публикуем в локальный брокер событие, пришедшее с другой реплики.
+// Сообщение перечитываем из базы, права не проверяем: это внутренний вызов, а не запрос пользователя.
+// Набор текста отмечаем и в локальном присутствии, иначе GET /presence этой реплики его не увидит
+func (s *Service) Relay(ctx context.Context, ev Event) error {
+	if ev.Type == EventTyping && s.presence != nil {
+		s.presence.Touch(ev.ChatID, ev.UserID, PresenceTyping, TypingTTL)
+		s.presence.Touch(ev.ChatID, ev.UserID, PresenceOnline, OnlineTTL)
+	}
+	if s.broker == nil {
+		return nil
+	}
+	if ev.MessageID != 0 && ev.Type != EventMessageDeleted {
+		m, err := s.repo.GetMessage(ctx, ev.ChatID, ev.MessageID)
+		if err != nil {
+			return err
+		}
+		msgs := []Message{*m}
+		if err := s.decorateMessages(ctx, msgs); err != nil {
+			return err
+		}
+		ev.Message = &msgs[0]
+	}
+	s.broker.Publish(ev)
+	return nil
+}
@@ -0,0 +1,26 @@
+package chat
+
+import "context"
+
+// ключ контекста для id пользователя, который делает запрос
+type userIDKey struct{}
+
+// WithUserID кладем id вызывающего пользователя в контекст (делает AuthMiddleware)
+func WithUserID(ctx context.Context, userID int64) context.Context {
+	return context.WithValue(ctx, userIDKey{}, userID)
+}
+
+// UserIDFromContext достаем id вызывающего пользователя из контекста
+func UserIDFromContext(ctx context.Context) (int64, bool) {
+	id, ok := ctx.Value(userIDKey{}).(int64)
+	return id, ok
+}
+
+// callerID id вызывающего пользователя или ErrUnauthenticated, если запрос пришел без личности
+func callerID(ctx context.Context) (int64, error) {
+	id, ok := UserIDFromContext(ctx)
+	if !ok {
+		return 0, ErrUnauthenticated
+	}
+	return id, nil
+}
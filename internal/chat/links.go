@@ -0,0 +1,209 @@
+package chat
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxLinkPreviews для скольких первых ссылок сообщения строим превью
+const MaxLinkPreviews = 3
+
+// LinkUnfurler достает метаданные страницы по ссылке. Реализация сама отвечает за таймауты, предел размера и защиту от SSRF
+type LinkUnfurler interface {
+	Unfurl(ctx context.Context, url string) (*LinkPreview, error)
+}
+
+// linkRescan как часто подбираем сообщения, ссылки которых не влезли в очередь
+const linkRescan = time.Minute
+
+// linkJob ссылки одного нового сообщения. pending у задач из пересканирования, после обработки снимаем отметку
+type linkJob struct {
+	chatID    int64
+	messageID int64
+	urls      []string
+	pending   bool
+}
+
+// WithUnfurler включаем превью ссылок, их строят воркеры RunUnfurlWorkers
+func WithUnfurler(u LinkUnfurler) Option {
+	return func(s *Service) {
+		s.unfurler = u
+		s.linkQueue = make(chan linkJob, 256)
+	}
+}
+
+// urlPattern ссылка http(s) до пробела, кавычки или угловой скобки
+var urlPattern = regexp.MustCompile(`https?://[^\s<>"'` + "`" + `]+`)
+
+// ExtractURLs первые max разных ссылок из текста. Знаки препинания в конце и непарные закрывающие скобки
+// считаем частью предложения, а не ссылки
+func ExtractURLs(text string, max int) []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, u := range urlPattern.FindAllString(text, -1) {
+		for {
+			trimmed := strings.TrimRight(u, ".,;:!?")
+			for _, pair := range []string{"()", "[]", "{}"} {
+				if strings.HasSuffix(trimmed, pair[1:]) && strings.Count(trimmed, pair[1:]) > strings.Count(trimmed, pair[:1]) {
+					trimmed = trimmed[:len(trimmed)-1]
+				}
+			}
+			if trimmed == u {
+				break
+			}
+			u = trimmed
+		}
+		if len(u) <= len("https://") || len(u) > 2048 || seen[u] {
+			continue
+		}
+		seen[u] = true
+		out = append(out, u)
+		if len(out) == max {
+			break
+		}
+	}
+	return out
+}
+
+// enqueueLinks ставим ссылки нового или отредактированного сообщения в очередь, не блокируя отправку.
+// Если очередь полна, отмечаем сообщение в базе, его подберет пересканирование
+func (s *Service) enqueueLinks(ctx context.Context, m *Message) {
+	if s.unfurler == nil {
+		return
+	}
+	urls := ExtractURLs(m.Text, MaxLinkPreviews)
+	if len(urls) == 0 {
+		return
+	}
+	select {
+	case s.linkQueue <- linkJob{chatID: m.ChatID, messageID: m.ID, urls: urls}:
+	default:
+		// сообщение уже сохранено, поэтому ошибку клиенту не отдаем: без отметки оно останется без превью
+		_ = s.repo.MarkUnfurlPending(context.WithoutCancel(ctx), m.ID)
+	}
+}
+
+// RunUnfurlWorkers запускаем workers воркеров превью ссылок и ждем отмены ctx.
+// Сообщения, не попавшие в полную очередь, подбираем сразу и потом раз в минуту
+func (s *Service) RunUnfurlWorkers(ctx context.Context, workers int, log *slog.Logger) {
+	if s.unfurler == nil {
+		return
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case job := <-s.linkQueue:
+					s.unfurlMessage(ctx, job, log)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	rescan := func() {
+		msgs, err := s.repo.ListUnfurlPending(ctx, cap(s.linkQueue))
+		if err != nil {
+			log.Warn("list unfurl pending", "err", err)
+			return
+		}
+		for _, m := range msgs {
+			job := linkJob{chatID: m.ChatID, messageID: m.ID, urls: ExtractURLs(m.Text, MaxLinkPreviews), pending: true}
+			// очередь снова полна: отметка остается до следующего прохода
+			select {
+			case s.linkQueue <- job:
+			default:
+				return
+			}
+		}
+	}
+	rescan()
+
+	ticker := time.NewTicker(linkRescan)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rescan()
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		}
+	}
+}
+
+// unfurlMessage строим превью ссылок сообщения. Ссылку без превью пропускаем, это не ошибка.
+// Отметку pending снимаем, только когда превью сохранены или их нет, иначе сообщение подберет следующее пересканирование
+func (s *Service) unfurlMessage(ctx context.Context, job linkJob, log *slog.Logger) {
+	previews := make([]LinkPreview, 0, len(job.urls))
+	for i, u := range job.urls {
+		p, err := s.unfurler.Unfurl(ctx, u)
+		if err != nil {
+			log.Debug("unfurl link", "url", u, "err", err)
+			continue
+		}
+		p.MessageID = job.messageID
+		p.URL = u
+		p.Position = i
+		previews = append(previews, *p)
+	}
+	if len(previews) == 0 {
+		s.clearUnfurlPending(ctx, job, log)
+		return
+	}
+
+	if err := s.repo.SaveLinkPreviews(ctx, job.chatID, job.messageID, previews); err != nil {
+		log.Warn("save link previews", "message_id", job.messageID, "err", err)
+		return
+	}
+	s.clearUnfurlPending(ctx, job, log)
+	// подписчики получают сообщение заново, уже с link_previews
+	if err := s.Relay(ctx, Event{Type: EventMessageUpdated, ChatID: job.chatID, MessageID: job.messageID}); err != nil {
+		log.Warn("publish link previews", "message_id", job.messageID, "err", err)
+	}
+}
+
+// clearUnfurlPending снимаем отметку с сообщения, которое подобрали при пересканировании
+func (s *Service) clearUnfurlPending(ctx context.Context, job linkJob, log *slog.Logger) {
+	if !job.pending {
+		return
+	}
+	if err := s.repo.ClearUnfurlPending(ctx, job.messageID); err != nil {
+		log.Warn("clear unfurl pending", "message_id", job.messageID, "err", err)
+	}
+}
+
+// attachLinkPreviews подгружаем превью ссылок всей страницы одним запросом, у удаленных сообщений их не показываем
+func (s *Service) attachLinkPreviews(ctx context.Context, msgs []Message) error {
+	ids := make([]int64, 0, len(msgs))
+	for _, m := range msgs {
+		if m.DeletedAt == nil {
+			ids = append(ids, m.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	byMsg, err := s.repo.ListLinkPreviews(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for i := range msgs {
+		if msgs[i].DeletedAt == nil {
+			msgs[i].LinkPreviews = byMsg[msgs[i].ID]
+		}
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strings"
 	"time"
+	"unicode"
 )
 
 // Chat модель
@@ -11,16 +12,174 @@ type Chat struct {
 	ID        int64     `gorm:"primaryKey;column:id" json:"id"`
 	Title     string    `gorm:"column:title;type:varchar(200);not null" json:"title"`
 	CreatedAt time.Time `gorm:"column:created_at;not null" json:"created_at"`
+	UpdatedAt time.Time `gorm:"column:updated_at;not null" json:"updated_at"`
+	// Version растет на каждое изменение чата, отдаем его клиенту как ETag
+	Version int64 `gorm:"column:version;not null" json:"version"`
 }
 
 // Message модель
 type Message struct {
+	ID        int64      `gorm:"primaryKey;column:id" json:"id"`
+	ChatID    int64      `gorm:"column:chat_id;not null" json:"chat_id"`
+	AuthorID  *int64     `gorm:"column:author_id" json:"author_id"`
+	Text      string     `gorm:"column:text;type:varchar(5000);not null" json:"text"`
+	ClientID  *string    `gorm:"column:client_id;type:uuid" json:"client_id,omitempty"`
+	ParentID  *int64     `gorm:"column:parent_id" json:"parent_id,omitempty"`
+	CreatedAt time.Time  `gorm:"column:created_at;not null" json:"created_at"`
+	EditedAt  *time.Time `gorm:"column:edited_at" json:"edited_at,omitempty"`
+	// DeletedAt у удаленного сообщения, текст при этом пустой, а само сообщение остается в истории как надгробие
+	DeletedAt *time.Time `gorm:"column:deleted_at" json:"deleted_at,omitempty"`
+
+	// Author подгружаем отдельным запросом на всю страницу сообщений, в таблице messages его нет
+	Author *Author `gorm:"-" json:"author,omitempty"`
+	// ReplyCount число живых ответов, только у корневых сообщений в страницах истории.
+	// Сами ответы тоже остаются в истории чата, у них есть parent_id
+	ReplyCount *int `gorm:"-" json:"reply_count,omitempty"`
+	// Reactions счетчики реакций, подгружаем одним запросом на всю страницу
+	Reactions []ReactionCount `gorm:"-" json:"reactions,omitempty"`
+	// Attachments файлы сообщения в порядке загрузки
+	Attachments []Attachment `gorm:"-" json:"attachments,omitempty"`
+	// State processing, пока превью вложений не готовы
+	State string `gorm:"-" json:"state,omitempty"`
+	// LinkPreviews превью ссылок из текста, появляются асинхронно после отправки
+	LinkPreviews []LinkPreview `gorm:"-" json:"link_previews,omitempty"`
+}
+
+// User модель
+type User struct {
+	ID        int64     `gorm:"primaryKey;column:id" json:"id"`
+	Name      string    `gorm:"column:name;type:varchar(100);not null" json:"name"`
+	CreatedAt time.Time `gorm:"column:created_at;not null" json:"created_at"`
+}
+
+// Author автор сообщения в ответах API
+type Author struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// MessageEdit прошлая версия текста сообщения, CreatedAt время, когда эту версию заменили
+type MessageEdit struct {
 	ID        int64     `gorm:"primaryKey;column:id" json:"id"`
-	ChatID    int64     `gorm:"column:chat_id;not null" json:"chat_id"`
+	MessageID int64     `gorm:"column:message_id;not null" json:"message_id"`
 	Text      string    `gorm:"column:text;type:varchar(5000);not null" json:"text"`
 	CreatedAt time.Time `gorm:"column:created_at;not null" json:"created_at"`
 }
 
+// ChatSummary чат и сводка по его сообщениям для списка чатов, Role это роль вызывающего в чате
+type ChatSummary struct {
+	Chat
+	Role          Role       `gorm:"column:role" json:"role"`
+	MessageCount  int64      `gorm:"column:message_count" json:"message_count"`
+	LastMessageAt *time.Time `gorm:"column:last_message_at" json:"last_message_at"`
+	// ReadState докуда вызывающий прочитал чат
+	ReadState
+}
+
+// ReadState последнее прочитанное участником сообщение (0, если ничего не отмечал) и сколько чужих сообщений после него
+type ReadState struct {
+	LastReadMessageID int64 `gorm:"column:last_read_message_id" json:"last_read_message_id"`
+	UnreadCount       int64 `gorm:"column:unread_count" json:"unread_count"`
+}
+
+// Member участник чата
+type Member struct {
+	ChatID    int64     `gorm:"primaryKey;column:chat_id" json:"chat_id"`
+	UserID    int64     `gorm:"primaryKey;column:user_id" json:"user_id"`
+	Role      Role      `gorm:"column:role;type:varchar(16);not null" json:"role"`
+	CreatedAt time.Time `gorm:"column:created_at;not null" json:"created_at"`
+	// Name имя пользователя, только для чтения из join с users
+	Name string `gorm:"->;column:name" json:"name,omitempty"`
+}
+
+// TableName таблица участников называется chat_members, а не members
+func (Member) TableName() string {
+	return "chat_members"
+}
+
+// Reaction реакция пользователя на сообщение
+type Reaction struct {
+	MessageID int64     `gorm:"primaryKey;column:message_id" json:"message_id"`
+	UserID    int64     `gorm:"primaryKey;column:user_id" json:"user_id"`
+	Emoji     string    `gorm:"primaryKey;column:emoji;type:varchar(64)" json:"emoji"`
+	CreatedAt time.Time `gorm:"column:created_at;not null" json:"created_at"`
+}
+
+// TableName таблица реакций называется message_reactions
+func (Reaction) TableName() string {
+	return "message_reactions"
+}
+
+// ReactionCount сколько раз сообщению поставили эмодзи, Me если среди них вызывающий
+type ReactionCount struct {
+	Emoji string `gorm:"column:emoji" json:"emoji"`
+	Count int    `gorm:"column:count" json:"count"`
+	Me    bool   `gorm:"column:me" json:"me"`
+}
+
+// Pin закрепленное сообщение чата
+type Pin struct {
+	ChatID    int64     `gorm:"primaryKey;column:chat_id" json:"chat_id"`
+	MessageID int64     `gorm:"primaryKey;column:message_id" json:"message_id"`
+	PinnedBy  *int64    `gorm:"column:pinned_by" json:"pinned_by"`
+	PinnedAt  time.Time `gorm:"column:pinned_at;not null" json:"pinned_at"`
+
+	// Message само сообщение, подгружаем отдельным запросом
+	Message *Message `gorm:"-" json:"message,omitempty"`
+}
+
+// TableName таблица закрепленных сообщений называется pinned_messages
+func (Pin) TableName() string {
+	return "pinned_messages"
+}
+
+// Attachment загруженный файл. Пока MessageID пустой, вложение видит только загрузивший,
+// после отправки сообщения с ним все участники чата. Сам файл лежит в BlobStore под StorageKey
+type Attachment struct {
+	ID          int64     `gorm:"primaryKey;column:id" json:"id"`
+	ChatID      int64     `gorm:"column:chat_id;not null" json:"chat_id"`
+	MessageID   *int64    `gorm:"column:message_id" json:"message_id,omitempty"`
+	UploaderID  int64     `gorm:"column:uploader_id;not null" json:"uploader_id"`
+	Filename    string    `gorm:"column:filename;type:varchar(255);not null" json:"filename"`
+	ContentType string    `gorm:"column:content_type;not null" json:"content_type"`
+	Size        int64     `gorm:"column:size;not null" json:"size"`
+	StorageKey  string    `gorm:"column:storage_key;not null" json:"-"`
+	CreatedAt   time.Time `gorm:"column:created_at;not null" json:"created_at"`
+
+	// ThumbnailState состояние превью (processing, ready, failed), только у картинок
+	ThumbnailState       string `gorm:"column:thumbnail_state;not null" json:"thumbnail_state,omitempty"`
+	ThumbnailKey         string `gorm:"column:thumbnail_key;not null" json:"-"`
+	ThumbnailContentType string `gorm:"column:thumbnail_content_type;not null" json:"-"`
+
+	// URL путь для скачивания через API, ThumbnailURL путь превью, когда оно готово
+	URL          string `gorm:"-" json:"url"`
+	ThumbnailURL string `gorm:"-" json:"thumbnail_url,omitempty"`
+}
+
+// LinkPreview метаданные страницы по ссылке из текста сообщения (OpenGraph или <title>)
+type LinkPreview struct {
+	MessageID   int64     `gorm:"primaryKey;column:message_id" json:"-"`
+	URL         string    `gorm:"primaryKey;column:url" json:"url"`
+	Position    int       `gorm:"column:position;not null" json:"-"`
+	Title       string    `gorm:"column:title;not null" json:"title,omitempty"`
+	Description string    `gorm:"column:description;not null" json:"description,omitempty"`
+	ImageURL    string    `gorm:"column:image_url;not null" json:"image_url,omitempty"`
+	SiteName    string    `gorm:"column:site_name;not null" json:"site_name,omitempty"`
+	CreatedAt   time.Time `gorm:"column:created_at;not null" json:"-"`
+}
+
+// TableName таблица превью ссылок называется link_previews
+func (LinkPreview) TableName() string {
+	return "link_previews"
+}
+
+// SearchHit сообщение, найденное поиском. Snippet фрагмент текста с найденными словами в <mark>, остальное экранировано для HTML
+type SearchHit struct {
+	Message
+	Rank    float32 `gorm:"column:rank" json:"rank"`
+	Snippet string  `gorm:"column:snippet" json:"snippet"`
+}
+
 // NormalizeTitle убираем пробелы и переводы строк в заголовке
 func NormalizeTitle(title string) string {
 	return strings.TrimSpace(title)
@@ -52,3 +211,95 @@ func ValidateText(text string) error {
 	}
 	return nil
 }
+
+// NormalizeClientID UUID клиента храним в нижнем регистре
+func NormalizeClientID(id string) string {
+	return strings.ToLower(strings.TrimSpace(id))
+}
+
+// ValidateClientID client_id необязательный, но если есть, это UUID вида xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx
+func ValidateClientID(id string) error {
+	id = NormalizeClientID(id)
+	if id == "" {
+		return nil
+	}
+	invalid := fmt.Errorf("%w: client_id must be a UUID", ErrValidation)
+	if len(id) != 36 {
+		return invalid
+	}
+	for i, c := range id {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return invalid
+			}
+		default:
+			if !strings.ContainsRune("0123456789abcdef", c) {
+				return invalid
+			}
+		}
+	}
+	return nil
+}
+
+// NormalizeEmoji убираем пробелы вокруг эмодзи
+func NormalizeEmoji(emoji string) string {
+	return strings.TrimSpace(emoji)
+}
+
+// ValidateEmoji эмодзи или короткий код вроде :+1:, до 32 символов без пробелов, управляющих символов и /
+func ValidateEmoji(emoji string) error {
+	emoji = NormalizeEmoji(emoji)
+	n := len([]rune(emoji))
+	if n < 1 || n > 32 || len(emoji) > 64 {
+		return fmt.Errorf("%w: emoji length must be 1..32", ErrValidation)
+	}
+	for _, c := range emoji {
+		if unicode.IsSpace(c) || unicode.IsControl(c) || c == '/' {
+			return fmt.Errorf("%w: invalid emoji", ErrValidation)
+		}
+	}
+	return nil
+}
+
+// NormalizeFilename оставляем только имя файла без пути, пустое имя заменяем на file
+func NormalizeFilename(name string) string {
+	name = strings.TrimSpace(name)
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	if name == "" || name == "." || name == ".." {
+		return "file"
+	}
+	return name
+}
+
+// ValidateFilename имя файла до 255 символов без управляющих символов
+func ValidateFilename(name string) error {
+	name = NormalizeFilename(name)
+	if len([]rune(name)) > 255 || len(name) > 1024 {
+		return fmt.Errorf("%w: filename length must be 1..255", ErrValidation)
+	}
+	for _, c := range name {
+		if unicode.IsControl(c) {
+			return fmt.Errorf("%w: invalid filename", ErrValidation)
+		}
+	}
+	return nil
+}
+
+// NormalizeName убираем пробелы и переводы строк в имени пользователя
+func NormalizeName(name string) string {
+	return strings.TrimSpace(name)
+}
+
+// ValidateName после того как убрали пробелы, проверяем длину имени
+func ValidateName(name string) error {
+	name = NormalizeName(name)
+	// проверяем длину по рунам если не ASCII символы
+	n := len([]rune(name))
+	if n < 1 || n > 100 {
+		return fmt.Errorf("%w: name length must be 1..100", ErrValidation)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package chat
+
+import "context"
+
+// DefaultPinLimit сколько сообщений можно закрепить в чате, если WithPinLimit не задан
+const DefaultPinLimit = 50
+
+// WithPinLimit задаем предел закрепленных сообщений в одном чате
+func WithPinLimit(n int) Option {
+	return func(s *Service) {
+		if n > 0 {
+			s.pinLimit = n
+		}
+	}
+}
+
+// PinMessage закрепляем сообщение, закреплять могут админы и владельцы.
+// Возвращаем закрепление и false, если сообщение уже было закреплено, при достижении предела ErrConflict
+func (s *Service) PinMessage(ctx context.Context, chatID, msgID int64) (*Pin, bool, error) {
+	member, err := s.authorize(ctx, chatID, RoleAdmin)
+	if err != nil {
+		return nil, false, err
+	}
+	pin, created, err := s.repo.PinMessage(ctx, chatID, msgID, member.UserID, s.pinLimit)
+	if err != nil {
+		return nil, false, err
+	}
+	m, err := s.repo.GetMessage(ctx, chatID, msgID)
+	if err != nil {
+		return nil, false, err
+	}
+	msgs := []Message{*m}
+	if err := s.decorateMessages(ctx, msgs); err != nil {
+		return nil, false, err
+	}
+	pin.Message = &msgs[0]
+	return pin, created, nil
+}
+
+// UnpinMessage открепляем сообщение, открепляют тоже админы и владельцы
+func (s *Service) UnpinMessage(ctx context.Context, chatID, msgID int64) error {
+	if _, err := s.authorize(ctx, chatID, RoleAdmin); err != nil {
+		return err
+	}
+	return s.repo.UnpinMessage(ctx, chatID, msgID)
+}
+
+// listPins закрепленные сообщения чата в том же виде, что и в истории. Права проверяет вызывающий, видны они любому участнику
+func (s *Service) listPins(ctx context.Context, chatID int64) ([]Pin, error) {
+	pins, err := s.repo.ListPins(ctx, chatID)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]Message, 0, len(pins))
+	for _, p := range pins {
+		if p.Message != nil {
+			msgs = append(msgs, *p.Message)
+		}
+	}
+	// закрепленное сообщение выглядит так же, как в истории: с реакциями, вложениями, ответами и превью ссылок
+	if err := s.decorateMessages(ctx, msgs); err != nil {
+		return nil, err
+	}
+	byID := make(map[int64]*Message, len(msgs))
+	for i := range msgs {
+		byID[msgs[i].ID] = &msgs[i]
+	}
+	for i := range pins {
+		pins[i].Message = byID[pins[i].MessageID]
+	}
+	return pins, nil
+}
@@ -0,0 +1,102 @@
+package chat
+
+import (
+	"context"
+	"time"
+)
+
+// Сколько живет отметка "печатает" и "онлайн". Онлайн продлевают живые подключения (WebSocket ping, SSE heartbeat),
+// поэтому его TTL больше их периода
+const (
+	TypingTTL = 6 * time.Second
+	OnlineTTL = 75 * time.Second
+)
+
+// PresenceKind вид эфемерного состояния участника
+type PresenceKind string
+
+const (
+	PresenceOnline PresenceKind = "online"
+	PresenceTyping PresenceKind = "typing"
+)
+
+// Presence кто сейчас в чате: онлайн (есть живое подключение) и печатает ли
+type Presence struct {
+	UserID int64  `json:"user_id"`
+	Name   string `json:"name,omitempty"`
+	Online bool   `json:"online"`
+	Typing bool   `json:"typing"`
+}
+
+// PresenceStore эфемерное состояние участников с TTL. В базу не пишется,
+// реализация в памяти процесса, общий бэкенд для нескольких реплик можно подключить через этот же интерфейс
+type PresenceStore interface {
+	// Touch отмечаем состояние kind пользователя в чате еще на ttl
+	Touch(chatID, userID int64, kind PresenceKind, ttl time.Duration)
+	// List неистекшие состояния участников чата
+	List(chatID int64) []Presence
+}
+
+// WithPresence включаем индикаторы набора и список присутствующих
+func WithPresence(p PresenceStore) Option {
+	return func(s *Service) {
+		s.presence = p
+	}
+}
+
+// Typing отмечаем, что вызывающий печатает, и рассылаем это живым подписчикам чата,
+// другие реплики узнают через pg_notify. Печатать может тот, кто может писать, то есть member и выше
+func (s *Service) Typing(ctx context.Context, chatID int64) error {
+	member, err := s.authorize(ctx, chatID, RoleMember)
+	if err != nil {
+		return err
+	}
+	if s.presence != nil {
+		s.presence.Touch(chatID, member.UserID, PresenceTyping, TypingTTL)
+		s.presence.Touch(chatID, member.UserID, PresenceOnline, OnlineTTL)
+	}
+	ev := Event{Type: EventTyping, ChatID: chatID, UserID: member.UserID}
+	s.publish(ev)
+	return s.repo.Notify(ctx, ev)
+}
+
+// KeepOnline продлеваем онлайн вызывающего в чате. Права не проверяем:
+// зовут только живые подключения, которые уже прошли Subscribe
+func (s *Service) KeepOnline(ctx context.Context, chatID int64) {
+	userID, ok := UserIDFromContext(ctx)
+	if !ok || s.presence == nil {
+		return
+	}
+	s.presence.Touch(chatID, userID, PresenceOnline, OnlineTTL)
+}
+
+// ListPresence кто из участников сейчас онлайн или печатает, с именами
+func (s *Service) ListPresence(ctx context.Context, chatID int64) ([]Presence, error) {
+	if _, err := s.authorize(ctx, chatID, RoleReadOnly); err != nil {
+		return nil, err
+	}
+	if s.presence == nil {
+		return []Presence{}, nil
+	}
+	list := s.presence.List(chatID)
+	if len(list) == 0 {
+		return list, nil
+	}
+
+	ids := make([]int64, len(list))
+	for i, p := range list {
+		ids[i] = p.UserID
+	}
+	users, err := s.repo.ListUsersByIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[int64]string, len(users))
+	for _, u := range users {
+		names[u.ID] = u.Name
+	}
+	for i := range list {
+		list[i].Name = names[list[i].UserID]
+	}
+	return list, nil
+}
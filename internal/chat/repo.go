@@ -4,23 +4,49 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"html"
+	"strings"
+	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type Repo struct {
-	db *gorm.DB
+	db       *gorm.DB
+	notifier TxNotifier
 }
 
-func NewRepo(db *gorm.DB) *Repo {
-	return &Repo{db: db}
+func NewRepo(db *gorm.DB, opts ...RepoOption) *Repo {
+	r := &Repo{db: db}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
 }
 
-// CreateChat создаем чат и сохраняем в бд
-func (r *Repo) CreateChat(ctx context.Context, title string) (*Chat, error) {
-	c := &Chat{Title: title}
+// Notify рассылаем другим репликам событие, у которого нет транзакции записи (например, набор текста)
+func (r *Repo) Notify(ctx context.Context, ev Event) error {
+	if r.notifier == nil {
+		return nil
+	}
+	if err := r.notifier.NotifyTx(r.db.WithContext(ctx), ev); err != nil {
+		return fmt.Errorf("notify %s: %w", ev.Type, err)
+	}
+	return nil
+}
+
+// CreateChat создаем чат и сохраняем в бд, создатель в той же транзакции становится владельцем
+func (r *Repo) CreateChat(ctx context.Context, title string, ownerID int64) (*Chat, error) {
+	c := &Chat{Title: title, Version: 1}
 
-	if err := r.db.WithContext(ctx).Create(c).Error; err != nil {
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(c).Error; err != nil {
+			return err
+		}
+		return tx.Create(&Member{ChatID: c.ID, UserID: ownerID, Role: RoleOwner}).Error
+	})
+	if err != nil {
 		return nil, fmt.Errorf("create chat: %w", err)
 	}
 	return c, nil
@@ -42,43 +68,1145 @@ func (r *Repo) GetChatByID(ctx context.Context, id int64) (*Chat, error) {
 	return &c, nil
 }
 
-// CreateMessage создаем сообщение в чате
-func (r *Repo) CreateMessage(ctx context.Context, chatID int64, text string) (*Message, error) {
+// UpdateChatTitle меняем заголовок и поднимаем версию одним UPDATE.
+// Если передана version, обновляем только эту версию чата, иначе ErrPreconditionFailed
+func (r *Repo) UpdateChatTitle(ctx context.Context, id int64, title string, version *int64) (*Chat, error) {
+	var c Chat
+	q := r.db.WithContext(ctx).
+		Model(&c).
+		Clauses(clause.Returning{}).
+		Where("id = ?", id)
+	if version != nil {
+		q = q.Where("version = ?", *version)
+	}
+
+	res := q.Updates(map[string]any{
+		"title":      title,
+		"updated_at": time.Now(),
+		"version":    gorm.Expr("version + 1"),
+	})
+	if res.Error != nil {
+		return nil, fmt.Errorf("update chat title: %w", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		// чата нет или его версия уже другая
+		if _, err := r.GetChatByID(ctx, id); err != nil {
+			return nil, err
+		}
+		return nil, ErrPreconditionFailed
+	}
+	return &c, nil
+}
+
+// CreateUser создаем пользователя и сохраняем в бд
+func (r *Repo) CreateUser(ctx context.Context, name string) (*User, error) {
+	u := &User{Name: name}
+
+	if err := r.db.WithContext(ctx).Create(u).Error; err != nil {
+		return nil, fmt.Errorf("create user: %w", err)
+	}
+	return u, nil
+}
+
+// CreateFirstUser создаем пользователя, только если пользователей еще нет, иначе ErrUnauthenticated.
+// Таблицу блокируем на время транзакции, чтобы два параллельных запроса не создали двух первых пользователей
+func (r *Repo) CreateFirstUser(ctx context.Context, name string) (*User, error) {
+	u := &User{Name: name}
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("LOCK TABLE users IN SHARE ROW EXCLUSIVE MODE").Error; err != nil {
+			return err
+		}
+		var exists bool
+		if err := tx.Raw("SELECT EXISTS (SELECT 1 FROM users)").Scan(&exists).Error; err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("%w: unknown user", ErrUnauthenticated)
+		}
+		return tx.Create(u).Error
+	})
+	if err != nil {
+		if errors.Is(err, ErrUnauthenticated) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("create first user: %w", err)
+	}
+	return u, nil
+}
+
+// GetUserByID возвращаем пользователя по id или ErrNotFound
+func (r *Repo) GetUserByID(ctx context.Context, id int64) (*User, error) {
+	var u User
+	err := r.db.WithContext(ctx).
+		First(&u, "id = ?", id).
+		Error
+
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("get user by id: %w", err)
+	}
+	return &u, nil
+}
+
+// ListUsersByIDs возвращаем пользователей по списку id одним запросом, отсутствующих просто нет в ответе
+func (r *Repo) ListUsersByIDs(ctx context.Context, ids []int64) ([]User, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	var users []User
+	if err := r.db.WithContext(ctx).Where("id IN ?", ids).Find(&users).Error; err != nil {
+		return nil, fmt.Errorf("list users by ids: %w", err)
+	}
+	return users, nil
+}
+
+// GetMember возвращаем участника чата или ErrNotFound
+func (r *Repo) GetMember(ctx context.Context, chatID, userID int64) (*Member, error) {
+	var m Member
+	err := r.db.WithContext(ctx).
+		First(&m, "chat_id = ? AND user_id = ?", chatID, userID).
+		Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("get member: %w", err)
+	}
+	return &m, nil
+}
+
+// ListMembers возвращаем участников чата с именами в порядке вступления
+func (r *Repo) ListMembers(ctx context.Context, chatID int64) ([]Member, error) {
+	var members []Member
+	err := r.db.WithContext(ctx).
+		Select("chat_members.*, users.name").
+		Joins("JOIN users ON users.id = chat_members.user_id").
+		Where("chat_members.chat_id = ?", chatID).
+		Order("chat_members.created_at ASC, chat_members.user_id ASC").
+		Find(&members).
+		Error
+	if err != nil {
+		return nil, fmt.Errorf("list members: %w", err)
+	}
+	return members, nil
+}
+
+// SaveMember добавляем участника или меняем его роль.
+// В чате всегда остается хотя бы один владелец, разжаловать последнего нельзя (ErrConflict)
+func (r *Repo) SaveMember(ctx context.Context, m *Member) error {
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if m.Role != RoleOwner {
+			if err := keepOwner(tx, m.ChatID, m.UserID); err != nil {
+				return err
+			}
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "chat_id"}, {Name: "user_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"role"}),
+		}).Create(m).Error
+	})
+	if err != nil {
+		if errors.Is(err, ErrConflict) {
+			return err
+		}
+		return fmt.Errorf("save member: %w", err)
+	}
+	return nil
+}
+
+// DeleteMember убираем участника из чата, последнего владельца убрать нельзя (ErrConflict)
+func (r *Repo) DeleteMember(ctx context.Context, chatID, userID int64) error {
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := keepOwner(tx, chatID, userID); err != nil {
+			return err
+		}
+		res := tx.Delete(&Member{}, "chat_id = ? AND user_id = ?", chatID, userID)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		// подключения удаленного участника могут висеть и на других репликах
+		if r.notifier != nil {
+			return r.notifier.NotifyTx(tx, Event{Type: EventMemberRemoved, ChatID: chatID, UserID: userID})
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, ErrConflict) || errors.Is(err, ErrNotFound) {
+			return err
+		}
+		return fmt.Errorf("delete member: %w", err)
+	}
+	return nil
+}
+
+// keepOwner проверяем, что после потери владения пользователем userID в чате останется владелец.
+// Строки владельцев берем под FOR UPDATE, чтобы два владельца не разжаловали друг друга одновременно
+func keepOwner(tx *gorm.DB, chatID, userID int64) error {
+	var owners []int64
+	err := tx.Model(&Member{}).
+		Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("chat_id = ? AND role = ?", chatID, RoleOwner).
+		Pluck("user_id", &owners).
+		Error
+	if err != nil {
+		return err
+	}
+	if len(owners) == 1 && owners[0] == userID {
+		return fmt.Errorf("%w: chat must keep at least one owner", ErrConflict)
+	}
+	return nil
+}
+
+// unreadJoins прочитанное участником cm и число чужих живых сообщений после него.
+// Сравнение (created_at, id) с позицией прочитанного идет по индексу (chat_id, created_at, id), а не по всему чату
+const unreadJoins = `LEFT JOIN chat_reads cr ON cr.chat_id = cm.chat_id AND cr.user_id = cm.user_id
+LEFT JOIN LATERAL (
+	SELECT COUNT(*) AS unread_count FROM messages m
+	WHERE m.chat_id = cm.chat_id
+	AND (m.created_at, m.id) > (COALESCE(cr.last_read_at, cm.created_at), COALESCE(cr.last_read_message_id, 0))
+	AND m.deleted_at IS NULL
+	AND m.author_id IS DISTINCT FROM cm.user_id
+) u ON true`
+
+// chatFilter условия выборки списка чатов
+type chatFilter struct {
+	UserID   int64   // только чаты, где пользователь участник
+	Title    string  // подстрока заголовка без учета регистра
+	Activity bool    // сортировка по последней активности вместо created_at
+	After    *cursor // курсор: ключ сортировки и id последнего чата прошлой страницы
+	Limit    int
+}
+
+// ListChats возвращает чаты пользователя от новых к старым вместе с его ролью, числом сообщений и временем последнего сообщения.
+// Удаленные сообщения не считаются, как и в GetChat. Последняя активность это время последнего сообщения, а для пустого чата время создания
+func (r *Repo) ListChats(ctx context.Context, f chatFilter) ([]ChatSummary, error) {
+	key := "chats.created_at"
+	if f.Activity {
+		key = "COALESCE(s.last_message_at, chats.created_at)"
+	}
+
+	// сводку и непрочитанные считаем подзапросами на каждый чат, они идут по индексу (chat_id, created_at, id)
+	q := r.db.WithContext(ctx).
+		Table("chats").
+		Select("chats.*, cm.role, s.message_count, s.last_message_at, "+
+			"COALESCE(cr.last_read_message_id, 0) AS last_read_message_id, u.unread_count").
+		Joins("JOIN chat_members cm ON cm.chat_id = chats.id AND cm.user_id = ?", f.UserID).
+		Joins("LEFT JOIN LATERAL (SELECT COUNT(*) AS message_count, MAX(m.created_at) AS last_message_at " +
+			"FROM messages m WHERE m.chat_id = chats.id AND m.deleted_at IS NULL) s ON true").
+		Joins(unreadJoins)
+	if f.Title != "" {
+		q = q.Where(`chats.title ILIKE ? ESCAPE '\'`, "%"+escapeLike(f.Title)+"%")
+	}
+	if f.After != nil {
+		q = q.Where("("+key+", chats.id) < (?, ?)", f.After.CreatedAt, f.After.ID)
+	}
+
+	var chats []ChatSummary
+	err := q.Order(key + " DESC, chats.id DESC").
+		Limit(f.Limit).
+		Find(&chats).
+		Error
+	if err != nil {
+		return nil, fmt.Errorf("list chats: %w", err)
+	}
+	return chats, nil
+}
+
+// CreateMessage создаем сообщение в чате. Если в чате уже есть сообщение автора с тем же client_id, возвращаем его и false
+func (r *Repo) CreateMessage(ctx context.Context, chatID, authorID int64, in NewMessage) (*Message, bool, error) {
+	var (
+		m       *Message
+		created bool
+	)
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		m, created, err = r.createMessageTx(tx, chatID, authorID, in)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return m, created, nil
+}
+
+// createResult итог вставки одного сообщения из пачки, Err только ErrConflict
+type createResult struct {
+	Message *Message
+	Created bool
+	Err     error
+}
+
+// CreateMessages вставляем пачку сообщений одного автора в одной транзакции.
+// Чужой client_id в partial режиме пропускаем с ErrConflict в результате, иначе откатываем всю пачку
+func (r *Repo) CreateMessages(ctx context.Context, chatID, authorID int64, items []NewMessage, partial bool) ([]createResult, error) {
+	res := make([]createResult, len(items))
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for i, in := range items {
+			m, created, err := r.createMessageTx(tx, chatID, authorID, in)
+			if errors.Is(err, ErrConflict) {
+				if !partial {
+					// пачка откатится, созданных сообщений в ответе быть не должно
+					res = make([]createResult, len(items))
+					res[i].Err = err
+					return err
+				}
+				res[i].Err = err
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			res[i] = createResult{Message: m, Created: created}
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, ErrConflict) {
+			return res, err
+		}
+		return nil, err
+	}
+	return res, nil
+}
+
+// createMessageTx вставка сообщения в транзакции tx.
+// Сообщение с тем же client_id в чате уже есть: не вставляем, а отдаем его, если у него тот же автор, иначе ErrConflict
+func (r *Repo) createMessageTx(tx *gorm.DB, chatID, authorID int64, in NewMessage) (*Message, bool, error) {
 	m := &Message{
-		ChatID: chatID,
-		Text:   text,
+		ChatID:   chatID,
+		AuthorID: &authorID,
+		Text:     in.Text,
+	}
+	if in.ClientID != "" {
+		m.ClientID = &in.ClientID
+	}
+	if in.ParentID != 0 {
+		m.ParentID = &in.ParentID
 	}
 
-	if err := r.db.WithContext(ctx).Create(m).Error; err != nil {
-		return nil, fmt.Errorf("create message: %w", err)
+	res := tx.Clauses(clause.OnConflict{
+		Columns:     []clause.Column{{Name: "chat_id"}, {Name: "client_id"}},
+		TargetWhere: clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: "client_id IS NOT NULL"}}},
+		DoNothing:   true,
+	}).Create(m)
+	if res.Error != nil {
+		return nil, false, fmt.Errorf("create message: %w", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		var existing Message
+		if err := tx.First(&existing, "chat_id = ? AND client_id = ?", chatID, in.ClientID).Error; err != nil {
+			return nil, false, fmt.Errorf("get message by client id: %w", err)
+		}
+		// client_id выдает клиент, чужое сообщение с тем же client_id не отдаем
+		if !isAuthor(&existing, authorID) {
+			return nil, false, fmt.Errorf("%w: client_id already used in this chat", ErrConflict)
+		}
+		return &existing, false, nil
+	}
+
+	// вложения привязываем в той же транзакции: только свои, из этого чата и еще ни к чему не привязанные
+	if len(in.AttachmentIDs) > 0 {
+		res := tx.Model(&Attachment{}).
+			Where("id IN ? AND chat_id = ? AND uploader_id = ? AND message_id IS NULL", in.AttachmentIDs, chatID, authorID).
+			Update("message_id", m.ID)
+		if res.Error != nil {
+			return nil, false, fmt.Errorf("link attachments: %w", res.Error)
+		}
+		if res.RowsAffected != int64(len(in.AttachmentIDs)) {
+			return nil, false, fmt.Errorf("%w: attachment not found or already used", ErrValidation)
+		}
+	}
+
+	// уведомление уходит в той же транзакции, другие реплики увидят его только после коммита
+	if r.notifier != nil {
+		if err := r.notifier.NotifyTx(tx, Event{Type: EventMessageCreated, ChatID: chatID, MessageID: m.ID}); err != nil {
+			return nil, false, fmt.Errorf("notify message created: %w", err)
+		}
 	}
-	return m, nil
+	return m, true, nil
 }
 
-// ListLastMessages возвращает последние limit сообщений в чате.
-// Используем вспомогательный индекс
-func (r *Repo) ListLastMessages(ctx context.Context, chatID int64, limit int) ([]Message, error) {
+// GetMessage возвращаем сообщение чата по id или ErrNotFound
+func (r *Repo) GetMessage(ctx context.Context, chatID, msgID int64) (*Message, error) {
+	var m Message
+	err := r.db.WithContext(ctx).
+		First(&m, "id = ? AND chat_id = ?", msgID, chatID).
+		Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("get message: %w", err)
+	}
+	return &m, nil
+}
+
+// UpdateMessageText меняем текст сообщения, прошлый текст сохраняем в message_edits.
+// Превью ссылок старого текста удаляем, новые строят воркеры. Удаленное сообщение не редактируется, для него ErrNotFound
+func (r *Repo) UpdateMessageText(ctx context.Context, chatID, msgID int64, text string) (*Message, error) {
+	var m Message
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		old, err := lockLiveMessage(tx, chatID, msgID)
+		if err != nil {
+			return err
+		}
+		if old.Text == text {
+			m = *old
+			return nil
+		}
+		if err := tx.Create(&MessageEdit{MessageID: msgID, Text: old.Text}).Error; err != nil {
+			return fmt.Errorf("save message edit: %w", err)
+		}
+		err = tx.Model(&m).
+			Clauses(clause.Returning{}).
+			Where("id = ?", msgID).
+			Updates(map[string]any{"text": text, "edited_at": time.Now()}).
+			Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Delete(&LinkPreview{}, "message_id = ?", msgID).Error; err != nil {
+			return fmt.Errorf("delete link previews: %w", err)
+		}
+		if r.notifier != nil {
+			return r.notifier.NotifyTx(tx, Event{Type: EventMessageUpdated, ChatID: chatID, MessageID: msgID})
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("update message text: %w", err)
+	}
+	return &m, nil
+}
+
+// DeleteMessage мягко удаляем сообщение: текст уходит в message_edits, в messages остается надгробие.
+// Вложения удаляем совсем и возвращаем, чтобы убрать их файлы из хранилища
+func (r *Repo) DeleteMessage(ctx context.Context, chatID, msgID int64) ([]Attachment, error) {
+	var removed []Attachment
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		old, err := lockLiveMessage(tx, chatID, msgID)
+		if err != nil {
+			return err
+		}
+		if err := tx.Create(&MessageEdit{MessageID: msgID, Text: old.Text}).Error; err != nil {
+			return fmt.Errorf("save message edit: %w", err)
+		}
+		// надгробие не может оставаться закрепленным и собирать реакции
+		if err := tx.Delete(&Pin{}, "chat_id = ? AND message_id = ?", chatID, msgID).Error; err != nil {
+			return fmt.Errorf("unpin message: %w", err)
+		}
+		if err := tx.Delete(&Reaction{}, "message_id = ?", msgID).Error; err != nil {
+			return fmt.Errorf("delete reactions: %w", err)
+		}
+		err = tx.Clauses(clause.Returning{}).
+			Where("message_id = ?", msgID).
+			Delete(&removed).
+			Error
+		if err != nil {
+			return fmt.Errorf("delete attachments: %w", err)
+		}
+		err = tx.Model(&Message{}).
+			Where("id = ?", msgID).
+			Updates(map[string]any{"text": "", "deleted_at": time.Now()}).
+			Error
+		if err != nil {
+			return err
+		}
+		if r.notifier != nil {
+			return r.notifier.NotifyTx(tx, Event{Type: EventMessageDeleted, ChatID: chatID, MessageID: msgID})
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("delete message: %w", err)
+	}
+	return removed, nil
+}
+
+// ListMessageEdits возвращаем прошлые версии текста сообщения от старых к новым
+func (r *Repo) ListMessageEdits(ctx context.Context, msgID int64) ([]MessageEdit, error) {
+	var edits []MessageEdit
+	err := r.db.WithContext(ctx).
+		Where("message_id = ?", msgID).
+		Order("id ASC").
+		Find(&edits).
+		Error
+	if err != nil {
+		return nil, fmt.Errorf("list message edits: %w", err)
+	}
+	return edits, nil
+}
+
+// lockLiveMessage берем неудаленное сообщение чата под FOR UPDATE, чтобы параллельные правки шли по очереди
+func lockLiveMessage(tx *gorm.DB, chatID, msgID int64) (*Message, error) {
+	var m Message
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		First(&m, "id = ? AND chat_id = ? AND deleted_at IS NULL", msgID, chatID).
+		Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &m, nil
+}
+
+// messageFilter условия выборки сообщений чата
+type messageFilter struct {
+	Before *cursor    // строго старше курсора
+	After  *cursor    // строго новее курсора
+	Since  *time.Time // created_at >= Since
+	Until  *time.Time // created_at < Until
+	Parent *int64     // только ответы на это сообщение
+	Desc   bool       // порядок выборки: от новых к старым
+	Limit  int
+}
+
+// ListMessages возвращает до limit сообщений чата по фильтру.
+// Порядок (created_at, id), keyset условия по курсорам идут по индексу idx_messages_chat_created_id без OFFSET
+func (r *Repo) ListMessages(ctx context.Context, chatID int64, f messageFilter) ([]Message, error) {
+	q := r.db.WithContext(ctx).Where("chat_id = ?", chatID)
+	if f.Before != nil {
+		q = q.Where("(created_at, id) < (?, ?)", f.Before.CreatedAt, f.Before.ID)
+	}
+	if f.After != nil {
+		q = q.Where("(created_at, id) > (?, ?)", f.After.CreatedAt, f.After.ID)
+	}
+	if f.Since != nil {
+		q = q.Where("created_at >= ?", *f.Since)
+	}
+	if f.Until != nil {
+		q = q.Where("created_at < ?", *f.Until)
+	}
+	if f.Parent != nil {
+		q = q.Where("parent_id = ?", *f.Parent)
+	}
+	if f.Desc {
+		q = q.Order("created_at DESC, id DESC")
+	} else {
+		q = q.Order("created_at ASC, id ASC")
+	}
+
 	var msgs []Message
+	if err := q.Limit(f.Limit).Find(&msgs).Error; err != nil {
+		return nil, fmt.Errorf("list messages: %w", err)
+	}
+	return msgs, nil
+}
+
+// CountReplies число живых ответов на каждое из сообщений ids одним запросом, сообщения без ответов в map не попадают
+func (r *Repo) CountReplies(ctx context.Context, ids []int64) (map[int64]int, error) {
+	counts := make(map[int64]int, len(ids))
+	if len(ids) == 0 {
+		return counts, nil
+	}
+	var rows []struct {
+		ParentID int64
+		N        int
+	}
+	err := r.db.WithContext(ctx).
+		Model(&Message{}).
+		Select("parent_id, COUNT(*) AS n").
+		Where("parent_id IN ? AND deleted_at IS NULL", ids).
+		Group("parent_id").
+		Scan(&rows).
+		Error
+	if err != nil {
+		return nil, fmt.Errorf("count replies: %w", err)
+	}
+	for _, row := range rows {
+		counts[row.ParentID] = row.N
+	}
+	return counts, nil
+}
+
+// AddReaction ставим реакцию на живое сообщение, повторная такая же реакция ничего не меняет и возвращает false.
+// Сообщение блокируем на чтение: параллельное удаление либо дождется вставки и снимет реакцию, либо вставка увидит надгробие
+func (r *Repo) AddReaction(ctx context.Context, re *Reaction) (bool, error) {
+	var created bool
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var m Message
+		err := tx.Clauses(clause.Locking{Strength: "SHARE"}).
+			Select("id").
+			First(&m, "id = ? AND deleted_at IS NULL", re.MessageID).
+			Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+		res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(re)
+		if res.Error != nil {
+			return res.Error
+		}
+		created = res.RowsAffected == 1
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return false, err
+		}
+		return false, fmt.Errorf("add reaction: %w", err)
+	}
+	return created, nil
+}
+
+// DeleteReaction снимаем реакцию, если ее не было, ErrNotFound
+func (r *Repo) DeleteReaction(ctx context.Context, msgID, userID int64, emoji string) error {
+	res := r.db.WithContext(ctx).
+		Delete(&Reaction{}, "message_id = ? AND user_id = ? AND emoji = ?", msgID, userID, emoji)
+	if res.Error != nil {
+		return fmt.Errorf("delete reaction: %w", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ReactionCounts счетчики реакций сообщений ids одним сгруппированным запросом.
+// Эмодзи идут в порядке первой реакции, Me отмечает реакции userID
+func (r *Repo) ReactionCounts(ctx context.Context, ids []int64, userID int64) (map[int64][]ReactionCount, error) {
+	counts := make(map[int64][]ReactionCount, len(ids))
+	if len(ids) == 0 {
+		return counts, nil
+	}
+	var rows []struct {
+		MessageID int64
+		ReactionCount
+	}
+	err := r.db.WithContext(ctx).
+		Model(&Reaction{}).
+		Select("message_id, emoji, COUNT(*) AS count, BOOL_OR(user_id = ?) AS me", userID).
+		Where("message_id IN ?", ids).
+		Group("message_id, emoji").
+		Order("message_id, MIN(created_at), emoji").
+		Scan(&rows).
+		Error
+	if err != nil {
+		return nil, fmt.Errorf("reaction counts: %w", err)
+	}
+	for _, row := range rows {
+		counts[row.MessageID] = append(counts[row.MessageID], row.ReactionCount)
+	}
+	return counts, nil
+}
+
+// PinMessage закрепляем живое сообщение. Уже закрепленное возвращаем как есть с false.
+// Строку чата берем под FOR UPDATE, чтобы параллельные закрепления не превысили limit, сверх лимита ErrConflict
+func (r *Repo) PinMessage(ctx context.Context, chatID, msgID, userID int64, limit int) (*Pin, bool, error) {
+	var (
+		pin     Pin
+		created bool
+	)
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var c Chat
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&c, "id = ?", chatID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+		// блокировка на чтение не дает параллельному удалению сообщения разминуться с закреплением
+		var m Message
+		err := tx.Clauses(clause.Locking{Strength: "SHARE"}).
+			Select("id").
+			First(&m, "id = ? AND chat_id = ? AND deleted_at IS NULL", msgID, chatID).
+			Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		err = tx.First(&pin, "chat_id = ? AND message_id = ?", chatID, msgID).Error
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		var n int64
+		if err := tx.Model(&Pin{}).Where("chat_id = ?", chatID).Count(&n).Error; err != nil {
+			return err
+		}
+		if n >= int64(limit) {
+			return fmt.Errorf("%w: chat already has %d pinned messages", ErrConflict, limit)
+		}
+		pin = Pin{ChatID: chatID, MessageID: msgID, PinnedBy: &userID}
+		if err := tx.Create(&pin).Error; err != nil {
+			return err
+		}
+		created = true
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrConflict) {
+			return nil, false, err
+		}
+		return nil, false, fmt.Errorf("pin message: %w", err)
+	}
+	return &pin, created, nil
+}
+
+// UnpinMessage открепляем сообщение, если оно не было закреплено, ErrNotFound
+func (r *Repo) UnpinMessage(ctx context.Context, chatID, msgID int64) error {
+	res := r.db.WithContext(ctx).Delete(&Pin{}, "chat_id = ? AND message_id = ?", chatID, msgID)
+	if res.Error != nil {
+		return fmt.Errorf("unpin message: %w", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ListPins закрепленные сообщения чата вместе с сообщениями, последние закрепленные первыми. Надгробия не показываем
+func (r *Repo) ListPins(ctx context.Context, chatID int64) ([]Pin, error) {
+	var pins []Pin
 	err := r.db.WithContext(ctx).
 		Where("chat_id = ?", chatID).
-		Order("created_at DESC").
+		Where("NOT EXISTS (SELECT 1 FROM messages m WHERE m.id = pinned_messages.message_id AND m.deleted_at IS NOT NULL)").
+		Order("pinned_at DESC, message_id DESC").
+		Find(&pins).
+		Error
+	if err != nil {
+		return nil, fmt.Errorf("list pins: %w", err)
+	}
+	if len(pins) == 0 {
+		return pins, nil
+	}
+
+	ids := make([]int64, len(pins))
+	for i, p := range pins {
+		ids[i] = p.MessageID
+	}
+	var msgs []Message
+	if err := r.db.WithContext(ctx).Where("id IN ?", ids).Find(&msgs).Error; err != nil {
+		return nil, fmt.Errorf("list pinned messages: %w", err)
+	}
+	byID := make(map[int64]*Message, len(msgs))
+	for i := range msgs {
+		byID[msgs[i].ID] = &msgs[i]
+	}
+	for i := range pins {
+		pins[i].Message = byID[pins[i].MessageID]
+	}
+	return pins, nil
+}
+
+// GetReadState докуда участник прочитал чат и сколько у него непрочитанных
+func (r *Repo) GetReadState(ctx context.Context, chatID, userID int64) (*ReadState, error) {
+	var st ReadState
+	err := r.db.WithContext(ctx).
+		Table("chat_members cm").
+		Select("COALESCE(cr.last_read_message_id, 0) AS last_read_message_id, u.unread_count").
+		Joins(unreadJoins).
+		Where("cm.chat_id = ? AND cm.user_id = ?", chatID, userID).
+		Take(&st).
+		Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("get read state: %w", err)
+	}
+	return &st, nil
+}
+
+// MarkRead сдвигаем прочитанное участником до сообщения msgID, а при msgID 0 до последнего сообщения чата.
+// Позиция только растет: отметка более раннего сообщения ничего не меняет
+func (r *Repo) MarkRead(ctx context.Context, chatID, userID, msgID int64) error {
+	var m Message
+	q := r.db.WithContext(ctx).Select("id, created_at").Where("chat_id = ?", chatID)
+	if msgID != 0 {
+		q = q.Where("id = ?", msgID)
+	}
+	err := q.Order("created_at DESC, id DESC").Take(&m).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// в пустом чате отмечать нечего
+			if msgID == 0 {
+				return nil
+			}
+			return ErrNotFound
+		}
+		return fmt.Errorf("get read message: %w", err)
+	}
+
+	err = r.db.WithContext(ctx).Exec(`
+INSERT INTO chat_reads (chat_id, user_id, last_read_message_id, last_read_at)
+VALUES (?, ?, ?, ?)
+ON CONFLICT (chat_id, user_id) DO UPDATE
+SET last_read_message_id = EXCLUDED.last_read_message_id,
+    last_read_at = EXCLUDED.last_read_at,
+    updated_at = NOW()
+WHERE (chat_reads.last_read_at, chat_reads.last_read_message_id) < (EXCLUDED.last_read_at, EXCLUDED.last_read_message_id)`,
+		chatID, userID, m.ID, m.CreatedAt).Error
+	if err != nil {
+		return fmt.Errorf("mark read: %w", err)
+	}
+	return nil
+}
+
+// ListMessagesAfterID возвращает до limit сообщений чата с id больше afterID в порядке id.
+// Нужен для дочитывания пропущенного по последовательности id (Last-Event-ID в SSE)
+func (r *Repo) ListMessagesAfterID(ctx context.Context, chatID, afterID int64, limit int) ([]Message, error) {
+	var msgs []Message
+	err := r.db.WithContext(ctx).
+		Where("chat_id = ? AND id > ?", chatID, afterID).
+		Order("id ASC").
 		Limit(limit).
 		Find(&msgs).
 		Error
 	if err != nil {
-		return nil, fmt.Errorf("list last messages: %w", err)
+		return nil, fmt.Errorf("list messages after id: %w", err)
 	}
 	return msgs, nil
 }
 
-// DeleteChat удаляет чат по id, сообщения удаляются каскадно на уровне БД
-func (r *Repo) DeleteChat(ctx context.Context, id int64) error {
-	res := r.db.WithContext(ctx).Delete(&Chat{}, "id = ?", id)
-	if res.Error != nil {
-		return fmt.Errorf("delete chat: %w", res.Error)
+// Маркеры найденных слов в ts_headline. Управляющие символы не встречаются в обычном тексте,
+// поэтому после экранирования HTML их можно безопасно заменить на <mark>
+const (
+	headlineStart = "\x02"
+	headlineStop  = "\x03"
+)
+
+// searchFilter параметры полнотекстового поиска.
+// ChatID ищет в одном чате, иначе во всех чатах, где UserID участник
+type searchFilter struct {
+	Query  string
+	ChatID int64
+	UserID int64
+	After  *searchCursor
+	Limit  int
+}
+
+// SearchMessages ищем сообщения по тексту, самые релевантные первыми, при равном rank новые первыми.
+// ts_headline считаем только для строк страницы, он дорогой
+func (r *Repo) SearchMessages(ctx context.Context, f searchFilter) ([]SearchHit, error) {
+	scope := "m.chat_id = @chat"
+	if f.ChatID == 0 {
+		scope = "m.chat_id IN (SELECT chat_id FROM chat_members WHERE user_id = @user)"
 	}
-	if res.RowsAffected == 0 {
-		return ErrNotFound
+	after := ""
+	if f.After != nil {
+		after = "WHERE (h.rank < CAST(@rank AS real) OR (h.rank = CAST(@rank AS real) AND h.id < @id))"
+	}
+	query := `
+WITH q AS (SELECT websearch_to_tsquery('russian', @query) AS q),
+hits AS (
+	SELECT m.id, ts_rank(m.search, q.q) AS rank
+	FROM messages m, q
+	WHERE m.search @@ q.q AND m.deleted_at IS NULL AND ` + scope + `
+)
+SELECT m.*, h.rank,
+	ts_headline('russian', m.text, q.q, @opts) AS snippet
+FROM (SELECT * FROM hits h ` + after + ` ORDER BY h.rank DESC, h.id DESC LIMIT @limit) h
+JOIN messages m ON m.id = h.id
+CROSS JOIN q
+ORDER BY h.rank DESC, h.id DESC`
+
+	args := map[string]any{
+		"query": f.Query,
+		"chat":  f.ChatID,
+		"user":  f.UserID,
+		"opts":  "StartSel=" + headlineStart + ", StopSel=" + headlineStop + ", MaxWords=30, MinWords=10, MaxFragments=2",
+		"limit": f.Limit,
+	}
+	if f.After != nil {
+		args["rank"] = f.After.Rank
+		args["id"] = f.After.ID
+	}
+
+	var hits []SearchHit
+	if err := r.db.WithContext(ctx).Raw(query, args).Scan(&hits).Error; err != nil {
+		return nil, fmt.Errorf("search messages: %w", err)
+	}
+	for i := range hits {
+		hits[i].Snippet = markHeadline(hits[i].Snippet)
+	}
+	return hits, nil
+}
+
+// markHeadline экранируем текст фрагмента и превращаем маркеры ts_headline в <mark>
+func markHeadline(s string) string {
+	s = html.EscapeString(s)
+	s = strings.ReplaceAll(s, headlineStart, "<mark>")
+	return strings.ReplaceAll(s, headlineStop, "</mark>")
+}
+
+// DeleteChat удаляет чат по id, сообщения удаляются каскадно на уровне БД. Возвращает удаленные вложения чата
+func (r *Repo) DeleteChat(ctx context.Context, id int64) ([]Attachment, error) {
+	var removed []Attachment
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// вложения удаляем сами, а не каскадом: так получаем ключи файлов, которые нужно убрать из хранилища
+		err := tx.Clauses(clause.Returning{}).
+			Where("chat_id = ?", id).
+			Delete(&removed).
+			Error
+		if err != nil {
+			return err
+		}
+		res := tx.Delete(&Chat{}, "id = ?", id)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		// подписчики чата на других репликах должны закрыть свои подключения
+		if r.notifier != nil {
+			return r.notifier.NotifyTx(tx, Event{Type: EventChatDeleted, ChatID: id})
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("delete chat: %w", err)
+	}
+	return removed, nil
+}
+
+// escapeLike экранируем спецсимволы LIKE, чтобы строка искалась как есть
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// CreateAttachment сохраняем метаданные загруженного вложения
+func (r *Repo) CreateAttachment(ctx context.Context, a *Attachment) error {
+	if err := r.db.WithContext(ctx).Create(a).Error; err != nil {
+		return fmt.Errorf("create attachment: %w", err)
 	}
 	return nil
 }
+
+// GetAttachment вложение чата по id или ErrNotFound
+func (r *Repo) GetAttachment(ctx context.Context, chatID, id int64) (*Attachment, error) {
+	var a Attachment
+	err := r.db.WithContext(ctx).
+		First(&a, "id = ? AND chat_id = ?", id, chatID).
+		Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("get attachment: %w", err)
+	}
+	return &a, nil
+}
+
+// ListAttachments вложения сообщений по их id, для каждого сообщения в порядке загрузки
+func (r *Repo) ListAttachments(ctx context.Context, msgIDs []int64) (map[int64][]Attachment, error) {
+	out := make(map[int64][]Attachment)
+	if len(msgIDs) == 0 {
+		return out, nil
+	}
+	var list []Attachment
+	err := r.db.WithContext(ctx).
+		Where("message_id IN ?", msgIDs).
+		Order("id ASC").
+		Find(&list).
+		Error
+	if err != nil {
+		return nil, fmt.Errorf("list attachments: %w", err)
+	}
+	for i := range list {
+		setAttachmentURLs(&list[i])
+		out[*list[i].MessageID] = append(out[*list[i].MessageID], list[i])
+	}
+	return out, nil
+}
+
+// DeletePendingAttachments удаляем непривязанные вложения, загруженные раньше before, и возвращаем их для очистки хранилища
+func (r *Repo) DeletePendingAttachments(ctx context.Context, before time.Time) ([]Attachment, error) {
+	var removed []Attachment
+	err := r.db.WithContext(ctx).
+		Clauses(clause.Returning{}).
+		Where("message_id IS NULL AND created_at < ?", before).
+		Delete(&removed).
+		Error
+	if err != nil {
+		return nil, fmt.Errorf("delete pending attachments: %w", err)
+	}
+	return removed, nil
+}
+
+// GetAttachmentByID вложение по id без привязки к чату, для фоновой обработки
+func (r *Repo) GetAttachmentByID(ctx context.Context, id int64) (*Attachment, error) {
+	var a Attachment
+	err := r.db.WithContext(ctx).First(&a, "id = ?", id).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("get attachment: %w", err)
+	}
+	return &a, nil
+}
+
+// ListProcessingThumbnails id вложений, загруженных раньше before, у которых превью еще в processing
+func (r *Repo) ListProcessingThumbnails(ctx context.Context, before time.Time, limit int) ([]int64, error) {
+	var ids []int64
+	err := r.db.WithContext(ctx).
+		Model(&Attachment{}).
+		Where("thumbnail_state = ? AND created_at < ?", ThumbnailProcessing, before).
+		Order("id ASC").
+		Limit(limit).
+		Pluck("id", &ids).
+		Error
+	if err != nil {
+		return nil, fmt.Errorf("list processing thumbnails: %w", err)
+	}
+	return ids, nil
+}
+
+// FinishThumbnail сохраняем итог обработки превью, если вложение еще в processing.
+// Если оно уже привязано к сообщению, другие реплики узнают об изменении сообщения после коммита.
+// Вложение могли удалить или уже обработать другим воркером, тогда возвращаем nil
+func (r *Repo) FinishThumbnail(ctx context.Context, id int64, state, key, contentType string) (*Attachment, error) {
+	var updated []Attachment
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&updated).
+			Clauses(clause.Returning{}).
+			Where("id = ? AND thumbnail_state = ?", id, ThumbnailProcessing).
+			Updates(map[string]any{
+				"thumbnail_state":        state,
+				"thumbnail_key":          key,
+				"thumbnail_content_type": contentType,
+			}).
+			Error
+		if err != nil {
+			return err
+		}
+		if len(updated) == 0 || updated[0].MessageID == nil || r.notifier == nil {
+			return nil
+		}
+		a := updated[0]
+		return r.notifier.NotifyTx(tx, Event{Type: EventMessageUpdated, ChatID: a.ChatID, MessageID: *a.MessageID})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("finish thumbnail: %w", err)
+	}
+	if len(updated) == 0 {
+		return nil, nil
+	}
+	return &updated[0], nil
+}
+
+// SaveLinkPreviews сохраняем превью ссылок сообщения, уже сохраненные URL пропускаем.
+// Сообщение блокируем и оставляем только ссылки, которые стоят на тех же местах в его текущем тексте:
+// пока строились превью, сообщение могли отредактировать или удалить.
+// Другие реплики узнают об изменении сообщения после коммита
+func (r *Repo) SaveLinkPreviews(ctx context.Context, chatID, msgID int64, previews []LinkPreview) error {
+	if len(previews) == 0 {
+		return nil
+	}
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		m, err := lockLiveMessage(tx, chatID, msgID)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		urls := ExtractURLs(m.Text, MaxLinkPreviews)
+		current := make([]LinkPreview, 0, len(previews))
+		for _, p := range previews {
+			if p.Position < len(urls) && urls[p.Position] == p.URL {
+				current = append(current, p)
+			}
+		}
+		if len(current) == 0 {
+			return nil
+		}
+		res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&current)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 || r.notifier == nil {
+			return nil
+		}
+		return r.notifier.NotifyTx(tx, Event{Type: EventMessageUpdated, ChatID: chatID, MessageID: msgID})
+	})
+	if err != nil {
+		return fmt.Errorf("save link previews: %w", err)
+	}
+	return nil
+}
+
+// MarkUnfurlPending отмечаем сообщение, превью ссылок которого не попали в очередь воркеров
+func (r *Repo) MarkUnfurlPending(ctx context.Context, msgID int64) error {
+	err := r.db.WithContext(ctx).
+		Exec("UPDATE messages SET unfurl_pending = TRUE WHERE id = ?", msgID).
+		Error
+	if err != nil {
+		return fmt.Errorf("mark unfurl pending: %w", err)
+	}
+	return nil
+}
+
+// ListUnfurlPending живые сообщения, ждущие превью ссылок, не больше limit, старые первыми
+func (r *Repo) ListUnfurlPending(ctx context.Context, limit int) ([]Message, error) {
+	var msgs []Message
+	err := r.db.WithContext(ctx).
+		Select("id", "chat_id", "text").
+		Where("unfurl_pending AND deleted_at IS NULL").
+		Order("id ASC").
+		Limit(limit).
+		Find(&msgs).
+		Error
+	if err != nil {
+		return nil, fmt.Errorf("list unfurl pending: %w", err)
+	}
+	return msgs, nil
+}
+
+// ClearUnfurlPending снимаем отметку после того, как воркер обработал ссылки сообщения
+func (r *Repo) ClearUnfurlPending(ctx context.Context, msgID int64) error {
+	err := r.db.WithContext(ctx).
+		Exec("UPDATE messages SET unfurl_pending = FALSE WHERE id = ? AND unfurl_pending", msgID).
+		Error
+	if err != nil {
+		return fmt.Errorf("clear unfurl pending: %w", err)
+	}
+	return nil
+}
+
+// ListLinkPreviews превью ссылок сообщений по их id, для каждого сообщения в порядке ссылок в тексте
+func (r *Repo) ListLinkPreviews(ctx context.Context, msgIDs []int64) (map[int64][]LinkPreview, error) {
+	out := make(map[int64][]LinkPreview)
+	if len(msgIDs) == 0 {
+		return out, nil
+	}
+	var list []LinkPreview
+	err := r.db.WithContext(ctx).
+		Where("message_id IN ?", msgIDs).
+		Order("message_id ASC, position ASC").
+		Find(&list).
+		Error
+	if err != nil {
+		return nil, fmt.Errorf("list link previews: %w", err)
+	}
+	for _, p := range list {
+		out[p.MessageID] = append(out[p.MessageID], p)
+	}
+	return out, nil
+}
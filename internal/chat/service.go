@@ -2,7 +2,9 @@ package chat
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 )
 
 // Константы лимитов
@@ -12,63 +14,1033 @@ const (
 )
 
 type Service struct {
-	repo *Repo
+	repo     *Repo
+	broker   Broker
+	pinLimit int
+	presence PresenceStore
+
+	blobs         BlobStore
+	attachmentMax int64
+	thumbnailer   Thumbnailer
+	thumbQueue    chan int64
+	unfurler      LinkUnfurler
+	linkQueue     chan linkJob
 }
 
-func NewService(repo *Repo) *Service {
-	return &Service{repo: repo}
+func NewService(repo *Repo, opts ...Option) *Service {
+	s := &Service{repo: repo, pinLimit: DefaultPinLimit, attachmentMax: DefaultAttachmentMaxBytes}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 // CreateChat создаем chat, используем функции для валидации из model.go и вызываем репозиторий
 // NormalizeTitle убираем пробелы и переводы строк в заголовке
 // ValidateTitle после того как убрали пробелы, проверяем длину заголовка
+// Создатель становится владельцем чата
 func (s *Service) CreateChat(ctx context.Context, title string) (*Chat, error) {
 	title = NormalizeTitle(title)
 	if err := ValidateTitle(title); err != nil {
 		return nil, err
 	}
-	return s.repo.CreateChat(ctx, title)
+	owner, err := s.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.repo.CreateChat(ctx, title, owner.ID)
+}
+
+// RenameChat меняем заголовок чата, используем те же функции валидации, что и при создании.
+// version это ожидаемая версия чата из If-Match, nil значит обновить без проверки. Переименовывают админы и владельцы
+func (s *Service) RenameChat(ctx context.Context, chatID int64, title string, version *int64) (*Chat, error) {
+	title = NormalizeTitle(title)
+	if err := ValidateTitle(title); err != nil {
+		return nil, err
+	}
+	if _, err := s.authorize(ctx, chatID, RoleAdmin); err != nil {
+		return nil, err
+	}
+	return s.repo.UpdateChatTitle(ctx, chatID, title, version)
+}
+
+// ChatListQuery параметры GET /chats: страница, фильтр по заголовку и сортировка
+type ChatListQuery struct {
+	Limit    int
+	Cursor   string
+	Title    string
+	Activity bool
+}
+
+// ChatListPage страница списка чатов, NextCursor пустой, если чатов больше нет
+type ChatListPage struct {
+	Chats      []ChatSummary
+	NextCursor string
+}
+
+// ListChats возвращаем чаты вызывающего от новых к старым (по created_at или по последней активности) и вызываем репозиторий
+func (s *Service) ListChats(ctx context.Context, q ChatListQuery) (*ChatListPage, error) {
+	limit, err := normalizeLimit(q.Limit)
+	if err != nil {
+		return nil, err
+	}
+	userID, err := callerID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	f := chatFilter{
+		UserID:   userID,
+		Title:    NormalizeTitle(q.Title),
+		Activity: q.Activity,
+		Limit:    limit + 1,
+	}
+	if q.Cursor != "" {
+		cur, err := decodeCursor(cursorChats, q.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		f.After = &cur
+	}
+
+	chats, err := s.repo.ListChats(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	page := &ChatListPage{Chats: chats}
+	if len(chats) > limit {
+		page.Chats = chats[:limit]
+		last := page.Chats[limit-1]
+		// курсор повторяет ключ сортировки последнего чата на странице
+		key := last.CreatedAt
+		if q.Activity && last.LastMessageAt != nil {
+			key = *last.LastMessageAt
+		}
+		page.NextCursor = encodeCursor(cursorChats, cursor{CreatedAt: key, ID: last.ID})
+	}
+	return page, nil
+}
+
+// NewMessage данные нового сообщения, автор берется из контекста запроса.
+// ClientID необязательный UUID от клиента, повтор с ним вернет уже созданное сообщение.
+// ParentID делает сообщение ответом в треде корневого сообщения того же чата
+type NewMessage struct {
+	Text     string
+	ClientID string
+	ParentID int64
+	// AttachmentIDs загруженные через UploadAttachment вложения, с ними текст можно не писать
+	AttachmentIDs []int64
 }
 
 // CreateMessage Создаем message, используем функции для валидации из model.go и вызываем репозиторий
 // NormalizeText убираем пробелы и переводы строк в поле текст
 // ValidateText после того как убрали пробелы, проверяем длину поля текст
-func (s *Service) CreateMessage(ctx context.Context, chatID int64, text string) (*Message, error) {
+// Второй результат false, если сообщение с таким client_id уже было и мы вернули его
+func (s *Service) CreateMessage(ctx context.Context, chatID int64, in NewMessage) (*Message, bool, error) {
+	in.Text = NormalizeText(in.Text)
+	attachments, err := s.checkAttachments(in.AttachmentIDs)
+	if err != nil {
+		return nil, false, err
+	}
+	in.AttachmentIDs = attachments
+	if in.Text != "" || len(attachments) == 0 {
+		if err := ValidateText(in.Text); err != nil {
+			return nil, false, err
+		}
+	}
+	in.ClientID = NormalizeClientID(in.ClientID)
+	if err := ValidateClientID(in.ClientID); err != nil {
+		return nil, false, err
+	}
+	// автор это пользователь из токена, он должен существовать
+	author, err := s.caller(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	// Условие по которому нельзя отправить сообщение в несуществующий чат
+	// писать могут участники с ролью member и выше
+	if _, err := s.authorize(ctx, chatID, RoleMember); err != nil {
+		return nil, false, err // ErrNotFound уйдёт наверх и превратится в 404 в HTTP, ErrForbidden в 403
+	}
+	if err := s.checkParent(ctx, chatID, in.ParentID); err != nil {
+		return nil, false, err
+	}
+
+	m, created, err := s.repo.CreateMessage(ctx, chatID, author.ID, in)
+	if err != nil {
+		return nil, false, err
+	}
+	// повтор с тем же client_id возвращает сообщение того же автора
+	m.Author = &Author{ID: author.ID, Name: author.Name}
+	one := []Message{*m}
+	if err := s.attachAttachments(ctx, one); err != nil {
+		return nil, false, err
+	}
+	m = &one[0]
+	if created {
+		s.publish(Event{Type: EventMessageCreated, ChatID: chatID, MessageID: m.ID, Message: m})
+		s.enqueueLinks(ctx, m)
+	}
+	return m, created, nil
+}
+
+// checkParent отвечать можно только на живое корневое сообщение этого же чата, треды одного уровня
+func (s *Service) checkParent(ctx context.Context, chatID, parentID int64) error {
+	if parentID == 0 {
+		return nil
+	}
+	if parentID < 0 {
+		return fmt.Errorf("%w: invalid parent_id", ErrValidation)
+	}
+	parent, err := s.repo.GetMessage(ctx, chatID, parentID)
+	if errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("%w: parent message not found in this chat", ErrValidation)
+	}
+	if err != nil {
+		return err
+	}
+	if parent.ParentID != nil {
+		return fmt.Errorf("%w: cannot reply to a reply", ErrValidation)
+	}
+	if parent.DeletedAt != nil {
+		return fmt.Errorf("%w: cannot reply to a deleted message", ErrValidation)
+	}
+	return nil
+}
+
+// MaxBatchSize сколько сообщений можно отправить в CreateMessages за раз
+const MaxBatchSize = 500
+
+// BatchResult итог по одному сообщению пачки: созданное или уже существующее (по client_id) сообщение либо ошибка
+type BatchResult struct {
+	Message *Message
+	Created bool
+	Err     error
+}
+
+// CreateMessages отправляем пачку сообщений от имени вызывающего: права и чат проверяем один раз, вставляем в одной транзакции.
+// Каждое сообщение проверяем как в CreateMessage, ответы в треды и вложения в пачке не принимаем.
+// В partial режиме невалидные и конфликтующие пропускаем, остальные создаем. Иначе при любой ошибке
+// не создаем ничего и возвращаем результаты с ошибками по индексам вместе с ErrValidation или ErrConflict
+func (s *Service) CreateMessages(ctx context.Context, chatID int64, items []NewMessage, partial bool) ([]BatchResult, error) {
+	// права проверяем до полей: чужой чат не должен узнавать подробности валидации
+	author, err := s.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.authorize(ctx, chatID, RoleMember); err != nil {
+		return nil, err
+	}
+	if len(items) == 0 || len(items) > MaxBatchSize {
+		return nil, fmt.Errorf("%w: batch must contain 1..%d messages", ErrValidation, MaxBatchSize)
+	}
+
+	results := make([]BatchResult, len(items))
+	valid := make([]NewMessage, 0, len(items))
+	index := make([]int, 0, len(items))
+	for i, in := range items {
+		in.Text = NormalizeText(in.Text)
+		in.ClientID = NormalizeClientID(in.ClientID)
+		// без checkParent и checkAttachments такие сообщения обошли бы проверки тредов и вложений
+		if in.ParentID != 0 || len(in.AttachmentIDs) > 0 {
+			results[i].Err = fmt.Errorf("%w: replies and attachments are not supported in batch", ErrValidation)
+			continue
+		}
+		if err := ValidateText(in.Text); err != nil {
+			results[i].Err = err
+			continue
+		}
+		if err := ValidateClientID(in.ClientID); err != nil {
+			results[i].Err = err
+			continue
+		}
+		valid = append(valid, in)
+		index = append(index, i)
+	}
+	if len(valid) < len(items) && !partial {
+		return results, fmt.Errorf("%w: batch has invalid messages", ErrValidation)
+	}
+	if len(valid) == 0 {
+		return results, nil
+	}
+
+	created, err := s.repo.CreateMessages(ctx, chatID, author.ID, valid, partial)
+	for j, res := range created {
+		results[index[j]] = BatchResult{Message: res.Message, Created: res.Created, Err: res.Err}
+	}
+	if err != nil {
+		if errors.Is(err, ErrConflict) {
+			return results, err
+		}
+		return nil, err
+	}
+
+	for _, res := range created {
+		if res.Message == nil {
+			continue
+		}
+		res.Message.Author = &Author{ID: author.ID, Name: author.Name}
+		if res.Created {
+			s.publish(Event{Type: EventMessageCreated, ChatID: chatID, MessageID: res.Message.ID, Message: res.Message})
+			s.enqueueLinks(ctx, res.Message)
+		}
+	}
+	return results, nil
+}
+
+// EditMessage меняем текст сообщения, валидация как при создании. Править можно только свои сообщения
+func (s *Service) EditMessage(ctx context.Context, chatID, msgID int64, text string) (*Message, error) {
 	text = NormalizeText(text)
 	if err := ValidateText(text); err != nil {
 		return nil, err
 	}
-	// Условие по которому нельзя отправить сообщение в несуществующий чат
-	if _, err := s.repo.GetChatByID(ctx, chatID); err != nil {
-		return nil, err // ErrNotFound уйдёт наверх и превратится в 404 в HTTP
+	member, err := s.authorize(ctx, chatID, RoleMember)
+	if err != nil {
+		return nil, err
 	}
-	return s.repo.CreateMessage(ctx, chatID, text)
+	m, err := s.repo.GetMessage(ctx, chatID, msgID)
+	if err != nil {
+		return nil, err
+	}
+	if !isAuthor(m, member.UserID) {
+		return nil, ErrForbidden
+	}
+	changed := m.Text != text
+	m, err = s.repo.UpdateMessageText(ctx, chatID, msgID, text)
+	if err != nil {
+		return nil, err
+	}
+	// подписчики получают сообщение в том же виде, что и в истории и через Relay на других репликах
+	one := []Message{*m}
+	if err := s.decorateMessages(ctx, one); err != nil {
+		return nil, err
+	}
+	m = &one[0]
+	// тот же текст ничего не меняет, событие не шлем
+	if changed {
+		s.publish(Event{Type: EventMessageUpdated, ChatID: chatID, MessageID: m.ID, Message: m})
+		// превью старых ссылок репозиторий удалил, строим для нового текста
+		s.enqueueLinks(ctx, m)
+	}
+	return m, nil
 }
 
-// GetChatWithMessages возвращаем чат и последние limit сообщений, отсортированные по created_at (ASC) и вызываем репозиторий
-func (s *Service) GetChatWithMessages(ctx context.Context, chatID int64, limit int) (*Chat, []Message, error) {
-	limit, err := normalizeLimit(limit)
+// DeleteMessage мягко удаляем сообщение, в истории чата от него остается надгробие.
+// Свои сообщения удаляют участники с правом писать, чужие админы и владельцы
+func (s *Service) DeleteMessage(ctx context.Context, chatID, msgID int64) error {
+	member, err := s.authorize(ctx, chatID, RoleReadOnly)
+	if err != nil {
+		return err
+	}
+	m, err := s.repo.GetMessage(ctx, chatID, msgID)
+	if err != nil {
+		return err
+	}
+	own := isAuthor(m, member.UserID) && member.Role.rank() >= RoleMember.rank()
+	if !own && member.Role.rank() < RoleAdmin.rank() {
+		return ErrForbidden
+	}
+	removed, err := s.repo.DeleteMessage(ctx, chatID, msgID)
+	if err != nil {
+		return err
+	}
+	s.publish(Event{Type: EventMessageDeleted, ChatID: chatID, MessageID: msgID})
+	// как и при удалении чата, ошибку хранилища клиенту не отдаем: строк вложений уже нет
+	_ = s.deleteBlobs(context.WithoutCancel(ctx), removed)
+	return nil
+}
+
+// AddReaction ставим реакцию вызывающего на живое сообщение, реагировать могут участники с ролью member и выше.
+// Возвращаем счетчики реакций сообщения и false, если такая реакция уже стояла
+func (s *Service) AddReaction(ctx context.Context, chatID, msgID int64, emoji string) ([]ReactionCount, bool, error) {
+	emoji = NormalizeEmoji(emoji)
+	if err := ValidateEmoji(emoji); err != nil {
+		return nil, false, err
+	}
+	member, err := s.authorize(ctx, chatID, RoleMember)
+	if err != nil {
+		return nil, false, err
+	}
+	m, err := s.repo.GetMessage(ctx, chatID, msgID)
+	if err != nil {
+		return nil, false, err
+	}
+	if m.DeletedAt != nil {
+		return nil, false, ErrNotFound
+	}
+	created, err := s.repo.AddReaction(ctx, &Reaction{MessageID: msgID, UserID: member.UserID, Emoji: emoji})
+	if err != nil {
+		return nil, false, err
+	}
+	counts, err := s.repo.ReactionCounts(ctx, []int64{msgID}, member.UserID)
+	if err != nil {
+		return nil, false, err
+	}
+	return counts[msgID], created, nil
+}
+
+// RemoveReaction снимаем свою реакцию с сообщения
+func (s *Service) RemoveReaction(ctx context.Context, chatID, msgID int64, emoji string) error {
+	emoji = NormalizeEmoji(emoji)
+	if err := ValidateEmoji(emoji); err != nil {
+		return err
+	}
+	member, err := s.authorize(ctx, chatID, RoleMember)
+	if err != nil {
+		return err
+	}
+	if _, err := s.repo.GetMessage(ctx, chatID, msgID); err != nil {
+		return err
+	}
+	return s.repo.DeleteReaction(ctx, msgID, member.UserID, emoji)
+}
+
+// MessageHistory возвращаем сообщение и прошлые версии его текста, история видна только админам и владельцам
+func (s *Service) MessageHistory(ctx context.Context, chatID, msgID int64) (*Message, []MessageEdit, error) {
+	if _, err := s.authorize(ctx, chatID, RoleAdmin); err != nil {
+		return nil, nil, err
+	}
+	m, err := s.repo.GetMessage(ctx, chatID, msgID)
 	if err != nil {
 		return nil, nil, err
 	}
-	c, err := s.repo.GetChatByID(ctx, chatID)
+	edits, err := s.repo.ListMessageEdits(ctx, msgID)
 	if err != nil {
 		return nil, nil, err
 	}
-	msgs, err := s.repo.ListLastMessages(ctx, chatID, limit) // приходит DESC
+	return m, edits, nil
+}
+
+// PageQuery параметры страницы истории: limit и не больше одного курсора before/after
+type PageQuery struct {
+	Limit  int
+	Before string
+	After  string
+}
+
+// ListQuery параметры GET /chats/{id}/messages: страница, диапазон дат [Since, Until) и порядок выдачи
+type ListQuery struct {
+	PageQuery
+	Since *time.Time
+	Until *time.Time
+	Desc  bool
+}
+
+// MessagePage страница сообщений и курсоры соседних страниц.
+// Курсоры всегда хронологические: PrevCursor передаем в before, чтобы получить более старые сообщения,
+// NextCursor в after для более новых. Пустой курсор значит, что в эту сторону сообщений больше нет
+type MessagePage struct {
+	Messages   []Message
+	NextCursor string
+	PrevCursor string
+}
+
+// ChatView чат и то, что GET /chats/{id} отдает рядом с сообщениями: закрепленные и позиция чтения вызывающего
+type ChatView struct {
+	Chat   *Chat
+	Pinned []Pin
+	Read   ReadState
+}
+
+// chatView читаем чат, закрепленные и позицию чтения участника, права уже проверил вызывающий
+func (s *Service) chatView(ctx context.Context, member *Member) (*ChatView, error) {
+	c, err := s.repo.GetChatByID(ctx, member.ChatID)
 	if err != nil {
+		return nil, err
+	}
+	pinned, err := s.listPins(ctx, member.ChatID)
+	if err != nil {
+		return nil, err
+	}
+	read, err := s.repo.GetReadState(ctx, member.ChatID, member.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return &ChatView{Chat: c, Pinned: pinned, Read: *read}, nil
+}
+
+// GetChatWithMessages возвращаем чат с закрепленными и непрочитанными и страницу сообщений,
+// отсортированных по (created_at, id) (ASC). Без курсора отдаем последние limit сообщений
+func (s *Service) GetChatWithMessages(ctx context.Context, chatID int64, q PageQuery) (*ChatView, *MessagePage, error) {
+	f, err := newPageFilter(q)
+	if err != nil {
+		return nil, nil, err
+	}
+	member, err := s.authorize(ctx, chatID, RoleReadOnly)
+	if err != nil {
+		return nil, nil, err
+	}
+	view, err := s.chatView(ctx, member)
+	if err != nil {
+		return nil, nil, err
+	}
+	// без курсора берем хвост истории
+	f.fromEnd = true
+	page, err := s.listPage(ctx, chatID, f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return view, page, nil
+}
+
+// MaxWait верхняя граница ожидания новых сообщений в WaitChatMessages
+const MaxWait = 60 * time.Second
+
+// WaitQuery параметры long-poll: сообщения с id больше AfterID, ждать их не дольше Wait
+type WaitQuery struct {
+	AfterID int64
+	Limit   int
+	Wait    time.Duration
+}
+
+// WaitChatMessages возвращаем чат (как в GetChatWithMessages) и сообщения после AfterID.
+// Если новых еще нет, держим вызов до первого message.created в чате, истечения Wait или отмены ctx.
+// Без брокера ждать нечем, отвечаем сразу
+func (s *Service) WaitChatMessages(ctx context.Context, chatID int64, q WaitQuery) (*ChatView, []Message, error) {
+	if q.AfterID < 0 {
+		return nil, nil, fmt.Errorf("%w: after_id must be non-negative", ErrValidation)
+	}
+	if q.Wait < 0 || q.Wait > MaxWait {
+		return nil, nil, fmt.Errorf("%w: wait must be between 0 and %s", ErrValidation, MaxWait)
+	}
+	limit, err := normalizeLimit(q.Limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	member, err := s.authorize(ctx, chatID, RoleReadOnly)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// подписываемся до первого чтения, чтобы не пропустить сообщение между чтением и ожиданием
+	var sub Subscription
+	if s.broker != nil && q.Wait > 0 {
+		sub = s.broker.Subscribe(chatID)
+		defer sub.Close()
+	}
+
+	msgs, err := s.repo.ListMessagesAfterID(ctx, chatID, q.AfterID, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(msgs) == 0 && sub != nil {
+		if err := waitCreated(ctx, sub, q.AfterID, q.Wait); err != nil {
+			return nil, nil, err
+		}
+		if msgs, err = s.repo.ListMessagesAfterID(ctx, chatID, q.AfterID, limit); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// чат читаем после ожидания: если его удалили, вернется ErrNotFound, а версия и непрочитанные будут свежими
+	view, err := s.chatView(ctx, member)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.decorateMessages(ctx, msgs); err != nil {
 		return nil, nil, err
 	}
-	// по условию сообщения отсортированы по created_at
-	// мы берем последние N по DESC и разворачиваем в ASC (быстрее и индексы уже в нужном порядке)
-	reverseMessages(msgs)
-	return c, msgs, nil
+	return view, msgs, nil
+}
+
+// Ждем события, после которого есть смысл перечитать сообщения: новое сообщение, удаление чата
+// или закрытие подписки брокером. По таймауту просто возвращаемся
+func waitCreated(ctx context.Context, sub Subscription, afterID int64, wait time.Duration) error {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case ev, ok := <-sub.Events():
+			if !ok {
+				return nil
+			}
+			if ev.Type == EventChatDeleted || (ev.Type == EventMessageCreated && ev.MessageID > afterID) {
+				return nil
+			}
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// ListMessages возвращаем страницу сообщений чата без загрузки самого чата.
+// Без курсора ASC начинает с самых старых сообщений (или с Since), DESC с самых новых (или с Until)
+func (s *Service) ListMessages(ctx context.Context, chatID int64, q ListQuery) (*MessagePage, error) {
+	f, err := newPageFilter(q.PageQuery)
+	if err != nil {
+		return nil, err
+	}
+	if q.Since != nil && q.Until != nil && !q.Since.Before(*q.Until) {
+		return nil, fmt.Errorf("%w: since must be before until", ErrValidation)
+	}
+	f.Since, f.Until = q.Since, q.Until
+	f.desc = q.Desc
+	f.fromEnd = q.Desc
+
+	// членство в чате заодно подтверждает, что чат существует, сам чат не читаем
+	if _, err := s.authorize(ctx, chatID, RoleReadOnly); err != nil {
+		return nil, err
+	}
+	return s.listPage(ctx, chatID, f)
+}
+
+// MessagesAfterID возвращаем до limit сообщений чата с id больше afterID в порядке id, читать может любой участник
+func (s *Service) MessagesAfterID(ctx context.Context, chatID, afterID int64, limit int) ([]Message, error) {
+	limit, err := normalizeLimit(limit)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.authorize(ctx, chatID, RoleReadOnly); err != nil {
+		return nil, err
+	}
+	msgs, err := s.repo.ListMessagesAfterID(ctx, chatID, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.decorateMessages(ctx, msgs); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// SearchQuery параметры поиска: текст запроса (синтаксис websearch: "фраза", or, -слово), размер страницы и курсор
+type SearchQuery struct {
+	Q      string
+	Limit  int
+	Cursor string
+}
+
+// SearchPage страница результатов поиска, NextCursor пустой, если результатов больше нет
+type SearchPage struct {
+	Results    []SearchHit
+	NextCursor string
+}
+
+// SearchChat ищем сообщения в одном чате, искать может любой участник
+func (s *Service) SearchChat(ctx context.Context, chatID int64, q SearchQuery) (*SearchPage, error) {
+	f, err := newSearchFilter(q)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.authorize(ctx, chatID, RoleReadOnly); err != nil {
+		return nil, err
+	}
+	f.ChatID = chatID
+	return s.search(ctx, f)
+}
+
+// Search ищем сообщения во всех чатах, где вызывающий участник
+func (s *Service) Search(ctx context.Context, q SearchQuery) (*SearchPage, error) {
+	f, err := newSearchFilter(q)
+	if err != nil {
+		return nil, err
+	}
+	userID, err := callerID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	f.UserID = userID
+	return s.search(ctx, f)
 }
 
-// DeleteChat удаляем каскадно
+// newSearchFilter текст запроса проходит те же правила, что и текст сообщения
+func newSearchFilter(q SearchQuery) (searchFilter, error) {
+	limit, err := normalizeLimit(q.Limit)
+	if err != nil {
+		return searchFilter{}, err
+	}
+	text := NormalizeText(q.Q)
+	if err := ValidateText(text); err != nil {
+		return searchFilter{}, err
+	}
+	f := searchFilter{Query: text, Limit: limit}
+	if q.Cursor != "" {
+		cur, err := decodeSearchCursor(q.Cursor)
+		if err != nil {
+			return searchFilter{}, err
+		}
+		f.After = &cur
+	}
+	return f, nil
+}
+
+// search берем limit+1, чтобы понять, есть ли следующая страница
+func (s *Service) search(ctx context.Context, f searchFilter) (*SearchPage, error) {
+	limit := f.Limit
+	f.Limit = limit + 1
+	hits, err := s.repo.SearchMessages(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	page := &SearchPage{Results: hits}
+	if len(hits) > limit {
+		page.Results = hits[:limit]
+		last := page.Results[limit-1]
+		page.NextCursor = encodeSearchCursor(searchCursor{Rank: last.Rank, ID: last.ID})
+	}
+
+	msgs := make([]Message, len(page.Results))
+	for i := range page.Results {
+		msgs[i] = page.Results[i].Message
+	}
+	if err := s.attachAuthors(ctx, msgs); err != nil {
+		return nil, err
+	}
+	for i := range page.Results {
+		page.Results[i].Author = msgs[i].Author
+	}
+	return page, nil
+}
+
+// ListReplies возвращаем страницу ответов в треде сообщения msgID, без курсора начиная с первых ответов
+func (s *Service) ListReplies(ctx context.Context, chatID, msgID int64, q PageQuery) (*MessagePage, error) {
+	f, err := newPageFilter(q)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.authorize(ctx, chatID, RoleReadOnly); err != nil {
+		return nil, err
+	}
+	if _, err := s.repo.GetMessage(ctx, chatID, msgID); err != nil {
+		return nil, err
+	}
+	f.Parent = &msgID
+	return s.listPage(ctx, chatID, f)
+}
+
+// MarkRead отмечаем чат прочитанным вызывающим до сообщения msgID (0 это последнее сообщение).
+// Позиция только растет, возвращаем ее вместе с числом оставшихся непрочитанных
+func (s *Service) MarkRead(ctx context.Context, chatID, msgID int64) (*ReadState, error) {
+	if msgID < 0 {
+		return nil, fmt.Errorf("%w: invalid message_id", ErrValidation)
+	}
+	member, err := s.authorize(ctx, chatID, RoleReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.repo.MarkRead(ctx, chatID, member.UserID, msgID); err != nil {
+		return nil, err
+	}
+	return s.repo.GetReadState(ctx, chatID, member.UserID)
+}
+
+// pageFilter разобранные параметры страницы
+type pageFilter struct {
+	messageFilter
+	desc    bool // порядок выдачи клиенту
+	fromEnd bool // без курсора начинаем с самых новых сообщений
+}
+
+// newPageFilter проверяем limit и курсоры
+func newPageFilter(q PageQuery) (pageFilter, error) {
+	var f pageFilter
+	limit, err := normalizeLimit(q.Limit)
+	if err != nil {
+		return f, err
+	}
+	if q.Before != "" && q.After != "" {
+		return f, fmt.Errorf("%w: only one of before/after is allowed", ErrValidation)
+	}
+	if q.Before != "" {
+		cur, err := decodeCursor(cursorMessages, q.Before)
+		if err != nil {
+			return f, err
+		}
+		f.Before = &cur
+	}
+	if q.After != "" {
+		cur, err := decodeCursor(cursorMessages, q.After)
+		if err != nil {
+			return f, err
+		}
+		f.After = &cur
+	}
+	f.Limit = limit
+	return f, nil
+}
+
+// listPage читаем limit+1 сообщений в сторону курсора, лишнее сообщение говорит, что дальше есть еще
+func (s *Service) listPage(ctx context.Context, chatID int64, f pageFilter) (*MessagePage, error) {
+	limit := f.Limit
+	mf := f.messageFilter
+	mf.Limit = limit + 1
+	// идем от курсора before или от конца истории назад, иначе вперед
+	mf.Desc = f.Before != nil || (f.After == nil && f.fromEnd)
+
+	msgs, err := s.repo.ListMessages(ctx, chatID, mf)
+	if err != nil {
+		return nil, err
+	}
+	more := len(msgs) > limit
+	if more {
+		msgs = msgs[:limit]
+	}
+
+	var hasPrev, hasNext bool
+	if mf.Desc {
+		// по условию сообщения отсортированы по (created_at, id)
+		// мы берем последние N по DESC и разворачиваем в ASC (быстрее и индексы уже в нужном порядке)
+		reverseMessages(msgs)
+		hasPrev = more
+		hasNext = f.Before != nil
+	} else {
+		hasNext = more
+		// старше курсора как минимум само сообщение курсора
+		hasPrev = f.After != nil
+	}
+
+	if err := s.decorateMessages(ctx, msgs); err != nil {
+		return nil, err
+	}
+
+	page := &MessagePage{Messages: msgs}
+	if len(msgs) > 0 {
+		if hasPrev {
+			page.PrevCursor = encodeCursor(cursorMessages, cursorOf(msgs[0]))
+		}
+		if hasNext {
+			page.NextCursor = encodeCursor(cursorMessages, cursorOf(msgs[len(msgs)-1]))
+		}
+	}
+	if f.desc {
+		reverseMessages(msgs)
+	}
+	return page, nil
+}
+
+// decorateMessages подгружаем для страницы все, что отдается вместе с сообщениями: авторов, число ответов,
+// реакции, вложения и превью ссылок. Все пути чтения истории идут через нее, чтобы формат сообщений совпадал
+func (s *Service) decorateMessages(ctx context.Context, msgs []Message) error {
+	if err := s.attachAuthors(ctx, msgs); err != nil {
+		return err
+	}
+	if err := s.attachReplyCounts(ctx, msgs); err != nil {
+		return err
+	}
+	if err := s.attachReactions(ctx, msgs); err != nil {
+		return err
+	}
+	if err := s.attachAttachments(ctx, msgs); err != nil {
+		return err
+	}
+	return s.attachLinkPreviews(ctx, msgs)
+}
+
+// CreateUser создаем пользователя, имя проходит trim и проверку длины.
+// Создавать пользователей могут только существующие пользователи. Исключение одно: пока пользователей нет,
+// токен с любым sub создает первого из них
+func (s *Service) CreateUser(ctx context.Context, name string) (*User, error) {
+	name = NormalizeName(name)
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+	if _, err := s.caller(ctx); err != nil {
+		if errors.Is(err, ErrUnauthenticated) {
+			return s.repo.CreateFirstUser(ctx, name)
+		}
+		return nil, err
+	}
+	return s.repo.CreateUser(ctx, name)
+}
+
+// GetUser возвращаем пользователя или ErrNotFound
+func (s *Service) GetUser(ctx context.Context, id int64) (*User, error) {
+	return s.repo.GetUserByID(ctx, id)
+}
+
+// caller пользователь, который делает запрос. Токен с несуществующим пользователем это тоже ErrUnauthenticated
+func (s *Service) caller(ctx context.Context) (*User, error) {
+	id, err := callerID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	u, err := s.repo.GetUserByID(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("%w: unknown user", ErrUnauthenticated)
+	}
+	return u, err
+}
+
+// attachReplyCounts считаем ответы корневых сообщений страницы одним запросом
+func (s *Service) attachReplyCounts(ctx context.Context, msgs []Message) error {
+	ids := make([]int64, 0, len(msgs))
+	for _, m := range msgs {
+		if m.ParentID == nil {
+			ids = append(ids, m.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	counts, err := s.repo.CountReplies(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for i := range msgs {
+		if msgs[i].ParentID == nil {
+			n := counts[msgs[i].ID]
+			msgs[i].ReplyCount = &n
+		}
+	}
+	return nil
+}
+
+// attachReactions подгружаем счетчики реакций всей страницы одним запросом, у удаленных сообщений их не показываем
+func (s *Service) attachReactions(ctx context.Context, msgs []Message) error {
+	ids := make([]int64, 0, len(msgs))
+	for _, m := range msgs {
+		if m.DeletedAt == nil {
+			ids = append(ids, m.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	userID, _ := UserIDFromContext(ctx)
+	counts, err := s.repo.ReactionCounts(ctx, ids, userID)
+	if err != nil {
+		return err
+	}
+	for i := range msgs {
+		msgs[i].Reactions = counts[msgs[i].ID]
+	}
+	return nil
+}
+
+// attachAuthors подгружаем авторов всей страницы сообщений одним запросом
+func (s *Service) attachAuthors(ctx context.Context, msgs []Message) error {
+	ids := make([]int64, 0, len(msgs))
+	seen := make(map[int64]bool, len(msgs))
+	for _, m := range msgs {
+		if m.AuthorID != nil && !seen[*m.AuthorID] {
+			seen[*m.AuthorID] = true
+			ids = append(ids, *m.AuthorID)
+		}
+	}
+	users, err := s.repo.ListUsersByIDs(ctx, ids)
+	if err != nil {
+		return err
+	}
+	byID := make(map[int64]*Author, len(users))
+	for _, u := range users {
+		byID[u.ID] = &Author{ID: u.ID, Name: u.Name}
+	}
+	for i := range msgs {
+		if msgs[i].AuthorID != nil {
+			msgs[i].Author = byID[*msgs[i].AuthorID]
+		}
+	}
+	return nil
+}
+
+// DeleteChat удаляем каскадно, удалить чат может только владелец. Файлы вложений убираем из хранилища после коммита
 // repo.DeleteChat уже возвращает ErrNotFound если RowsAffected == 0
 func (s *Service) DeleteChat(ctx context.Context, chatID int64) error {
-	return s.repo.DeleteChat(ctx, chatID)
+	if _, err := s.authorize(ctx, chatID, RoleOwner); err != nil {
+		return err
+	}
+	removed, err := s.repo.DeleteChat(ctx, chatID)
+	if err != nil {
+		return err
+	}
+	s.publish(Event{Type: EventChatDeleted, ChatID: chatID})
+	// чат уже удален, поэтому ошибку хранилища клиенту не отдаем: файлы без строк никто не найдет
+	_ = s.deleteBlobs(context.WithoutCancel(ctx), removed)
+	return nil
+}
+
+// Subscribe подписываемся на события чата, подписаться может любой участник.
+// Подписку нужно закрыть через Close
+func (s *Service) Subscribe(ctx context.Context, chatID int64) (Subscription, error) {
+	if s.broker == nil {
+		return nil, errors.New("live updates are not configured")
+	}
+	member, err := s.authorize(ctx, chatID, RoleReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	if s.presence != nil {
+		s.presence.Touch(chatID, member.UserID, PresenceOnline, OnlineTTL)
+	}
+	return s.broker.Subscribe(chatID), nil
+}
+
+// ListMembers участники чата, список видят все участники
+func (s *Service) ListMembers(ctx context.Context, chatID int64) ([]Member, error) {
+	if _, err := s.authorize(ctx, chatID, RoleReadOnly); err != nil {
+		return nil, err
+	}
+	return s.repo.ListMembers(ctx, chatID)
+}
+
+// AddMember добавляем участника или меняем его роль, возвращаем участника и признак, что он новый.
+// Админ выдает и меняет только роли ниже своей, владелец любые
+func (s *Service) AddMember(ctx context.Context, chatID, userID int64, role Role) (*Member, bool, error) {
+	if _, err := ParseRole(string(role)); err != nil {
+		return nil, false, err
+	}
+	actor, err := s.authorize(ctx, chatID, RoleAdmin)
+	if err != nil {
+		return nil, false, err
+	}
+	if _, err := s.repo.GetUserByID(ctx, userID); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, false, fmt.Errorf("%w: user not found", ErrValidation)
+		}
+		return nil, false, err
+	}
+
+	existing, err := s.repo.GetMember(ctx, chatID, userID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, false, err
+	}
+	if actor.Role != RoleOwner {
+		if role.rank() >= actor.Role.rank() || (existing != nil && existing.Role.rank() >= actor.Role.rank()) {
+			return nil, false, ErrForbidden
+		}
+	}
+
+	m := &Member{ChatID: chatID, UserID: userID, Role: role}
+	if existing != nil {
+		m.CreatedAt = existing.CreatedAt
+	}
+	if err := s.repo.SaveMember(ctx, m); err != nil {
+		return nil, false, err
+	}
+	return m, existing == nil, nil
+}
+
+// RemoveMember убираем участника. Выйти из чата сам может любой участник,
+// убрать другого может админ (только роли ниже своей) или владелец.
+// По событию member.removed открытые WebSocket и SSE удаленного участника закрываются
+func (s *Service) RemoveMember(ctx context.Context, chatID, userID int64) error {
+	actor, err := s.authorize(ctx, chatID, RoleReadOnly)
+	if err != nil {
+		return err
+	}
+	if actor.UserID != userID {
+		if actor.Role.rank() < RoleAdmin.rank() {
+			return ErrForbidden
+		}
+		target, err := s.repo.GetMember(ctx, chatID, userID)
+		if err != nil {
+			return err
+		}
+		if actor.Role != RoleOwner && target.Role.rank() >= actor.Role.rank() {
+			return ErrForbidden
+		}
+	}
+	if err := s.repo.DeleteMember(ctx, chatID, userID); err != nil {
+		return err
+	}
+	s.publish(Event{Type: EventMemberRemoved, ChatID: chatID, UserID: userID})
+	return nil
+}
+
+// isAuthor сообщение написал пользователь userID
+func isAuthor(m *Message, userID int64) bool {
+	return m.AuthorID != nil && *m.AuthorID == userID
 }
 
 // Валидация лимита
@@ -0,0 +1,176 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Состояние превью вложения. У файлов, для которых превью не делается, состояния нет
+const (
+	ThumbnailProcessing = "processing"
+	ThumbnailReady      = "ready"
+	ThumbnailFailed     = "failed"
+)
+
+// MessageProcessing состояние сообщения, у которого превью вложений еще готовятся
+const MessageProcessing = "processing"
+
+// thumbnailRescan как часто подбираем вложения, застрявшие в processing: очередь была полна или процесс перезапускался
+const thumbnailRescan = time.Minute
+
+// Thumbnailer делает превью картинки, возвращает содержимое и его Content-Type
+type Thumbnailer interface {
+	Thumbnail(r io.Reader) ([]byte, string, error)
+}
+
+// WithThumbnailer включаем превью для PNG, JPEG и GIF вложений. Сами превью делают воркеры RunThumbnailWorkers
+func WithThumbnailer(t Thumbnailer) Option {
+	return func(s *Service) {
+		s.thumbnailer = t
+		s.thumbQueue = make(chan int64, 256)
+	}
+}
+
+// needsThumbnail для каких типов вложений делаем превью
+func (s *Service) needsThumbnail(contentType string) bool {
+	if s.thumbnailer == nil {
+		return false
+	}
+	switch contentType {
+	case "image/png", "image/jpeg", "image/gif":
+		return true
+	}
+	return false
+}
+
+// enqueueThumbnail ставим вложение в очередь, не блокируясь. Если очередь полна, его подберет пересканирование
+func (s *Service) enqueueThumbnail(id int64) {
+	select {
+	case s.thumbQueue <- id:
+	default:
+	}
+}
+
+// RunThumbnailWorkers запускаем workers воркеров превью и ждем отмены ctx.
+// Вложения, оставшиеся в processing (после перезапуска или при полной очереди), подбираем сразу и потом раз в минуту
+func (s *Service) RunThumbnailWorkers(ctx context.Context, workers int, log *slog.Logger) {
+	if s.thumbnailer == nil || s.blobs == nil {
+		return
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case id := <-s.thumbQueue:
+					if err := s.makeThumbnail(ctx, id); err != nil {
+						log.Warn("make thumbnail", "attachment_id", id, "err", err)
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	rescan := func(before time.Time) {
+		ids, err := s.repo.ListProcessingThumbnails(ctx, before, cap(s.thumbQueue))
+		if err != nil {
+			log.Warn("list processing thumbnails", "err", err)
+			return
+		}
+		for _, id := range ids {
+			s.enqueueThumbnail(id)
+		}
+	}
+	rescan(time.Now())
+
+	ticker := time.NewTicker(thumbnailRescan)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// свежие вложения и так в очереди
+			rescan(time.Now().Add(-thumbnailRescan))
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		}
+	}
+}
+
+// makeThumbnail делаем превью одного вложения. Картинку, которую не удалось разобрать, отмечаем failed.
+// Возвращаем только ошибки хранилищ: вложение остается в processing и будет повторено
+func (s *Service) makeThumbnail(ctx context.Context, id int64) error {
+	a, err := s.repo.GetAttachmentByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if a.ThumbnailState != ThumbnailProcessing {
+		return nil
+	}
+
+	rc, err := s.blobs.Get(ctx, a.StorageKey)
+	if err != nil {
+		return err
+	}
+	data, contentType, thumbErr := s.thumbnailer.Thumbnail(rc)
+	_ = rc.Close()
+
+	state, key := ThumbnailReady, a.StorageKey+".thumb"
+	if thumbErr != nil {
+		state, key, contentType = ThumbnailFailed, "", ""
+	} else if err := s.blobs.Put(ctx, key, bytes.NewReader(data), int64(len(data)), contentType); err != nil {
+		return fmt.Errorf("put thumbnail: %w", err)
+	}
+
+	a, err = s.repo.FinishThumbnail(ctx, id, state, key, contentType)
+	if err != nil {
+		return err
+	}
+	// вложение удалили вместе с чатом или сообщением, пока делали превью: его файл уже убран, убираем и превью.
+	// Если же его обработал другой воркер, превью с тем же ключом нужно ему
+	if a == nil && state == ThumbnailReady {
+		if _, err := s.repo.GetAttachmentByID(ctx, id); errors.Is(err, ErrNotFound) {
+			return s.blobs.Delete(ctx, key)
+		}
+	}
+	// сообщение поменялось: подписчики получают его заново уже с thumbnail_url
+	if a != nil && a.MessageID != nil {
+		if err := s.Relay(ctx, Event{Type: EventMessageUpdated, ChatID: a.ChatID, MessageID: *a.MessageID}); err != nil {
+			return err
+		}
+	}
+	if thumbErr != nil {
+		return thumbErr
+	}
+	return nil
+}
+
+// OpenThumbnail превью вложения, права те же, что у самого вложения. Пока превью не готово ErrNotFound
+func (s *Service) OpenThumbnail(ctx context.Context, chatID, attID int64) (*Attachment, io.ReadCloser, error) {
+	a, err := s.visibleAttachment(ctx, chatID, attID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if a.ThumbnailState != ThumbnailReady {
+		return nil, nil, ErrNotFound
+	}
+	thumb, err := s.blobs.Get(ctx, a.ThumbnailKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return a, thumb, nil
+}
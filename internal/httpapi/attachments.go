@@ -0,0 +1,105 @@
+package httpapi
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// attachmentTimeout сколько даем на загрузку или скачивание одного вложения, общий ReadTimeout сервера для файлов мал
+const attachmentTimeout = 10 * time.Minute
+
+// UploadAttachment POST /chats/{id}/attachments
+// Тело это сам файл, имя в query filename, либо multipart/form-data с файлом в поле file.
+// Тело читается потоком, лимит 1 МБ из decodeJSON здесь не действует, предел размера проверяет сервис (413)
+func (a *API) UploadAttachment(w http.ResponseWriter, r *http.Request, chatID int64) {
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(time.Now().Add(attachmentTimeout))
+	_ = rc.SetWriteDeadline(time.Now().Add(attachmentTimeout))
+
+	filename := r.URL.Query().Get("filename")
+	var body io.Reader = r.Body
+
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "multipart/form-data" {
+		mr, err := r.MultipartReader()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid multipart body")
+			return
+		}
+		// берем первую часть с полем file, остальные поля не нужны
+		for {
+			part, err := mr.NextPart()
+			if errors.Is(err, io.EOF) {
+				writeError(w, http.StatusBadRequest, "file field is required")
+				return
+			}
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid multipart body")
+				return
+			}
+			if part.FormName() == "file" {
+				if filename == "" {
+					filename = part.FileName()
+				}
+				body = part
+				break
+			}
+		}
+	}
+
+	att, err := a.svc.UploadAttachment(r.Context(), chatID, filename, body)
+	if err != nil {
+		writeDomainError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, att)
+}
+
+// GetAttachment GET /chats/{id}/attachments/{attID}
+// Отдает содержимое с определенным при загрузке Content-Type. Картинки inline, остальное скачивается файлом
+func (a *API) GetAttachment(w http.ResponseWriter, r *http.Request, chatID, attID int64) {
+	att, body, err := a.svc.OpenAttachment(r.Context(), chatID, attID)
+	if err != nil {
+		writeDomainError(w, err)
+		return
+	}
+	defer func() { _ = body.Close() }()
+
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(attachmentTimeout))
+
+	disposition := "attachment"
+	if strings.HasPrefix(att.ContentType, "image/") && att.ContentType != "image/svg+xml" {
+		disposition = "inline"
+	}
+	h := w.Header()
+	h.Set("Content-Type", att.ContentType)
+	h.Set("Content-Length", strconv.FormatInt(att.Size, 10))
+	h.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": att.Filename}))
+	// браузер не должен угадывать тип сам, иначе загруженный html выполнится
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Cache-Control", "private, max-age=86400")
+	w.WriteHeader(http.StatusOK)
+	_, _ = io.Copy(w, body)
+}
+
+// GetThumbnail GET /chats/{id}/attachments/{attID}/thumbnail
+// Превью картинки, пока оно готовится или если картинку не удалось разобрать, 404
+func (a *API) GetThumbnail(w http.ResponseWriter, r *http.Request, chatID, attID int64) {
+	att, body, err := a.svc.OpenThumbnail(r.Context(), chatID, attID)
+	if err != nil {
+		writeDomainError(w, err)
+		return
+	}
+	defer func() { _ = body.Close() }()
+
+	h := w.Header()
+	h.Set("Content-Type", att.ThumbnailContentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Cache-Control", "private, max-age=86400")
+	w.WriteHeader(http.StatusOK)
+	_, _ = io.Copy(w, body)
+}
@@ -0,0 +1,135 @@
+package httpapi
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+
+	"hitalent/internal/chat"
+)
+
+// TokenVerifier проверяет bearer токены (JWT HS256 и/или RS256) и достает из них id пользователя
+type TokenVerifier struct {
+	hsKey []byte
+	rsKey *rsa.PublicKey
+}
+
+// NewTokenVerifier нужен хотя бы один ключ: секрет для HS256 или публичный ключ для RS256
+func NewTokenVerifier(hsKey []byte, rsKey *rsa.PublicKey) (*TokenVerifier, error) {
+	if len(hsKey) == 0 && rsKey == nil {
+		return nil, errors.New("no jwt key configured")
+	}
+	return &TokenVerifier{hsKey: hsKey, rsKey: rsKey}, nil
+}
+
+// LoadTokenVerifier читаем ключи из окружения:
+// JWT_HS256_SECRET или JWT_HS256_SECRET_FILE для HS256,
+// JWT_RS256_PUBLIC_KEY или JWT_RS256_PUBLIC_KEY_FILE (PEM) для RS256
+func LoadTokenVerifier() (*TokenVerifier, error) {
+	secret, err := envOrFile("JWT_HS256_SECRET")
+	if err != nil {
+		return nil, err
+	}
+	pem, err := envOrFile("JWT_RS256_PUBLIC_KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	var rsKey *rsa.PublicKey
+	if len(pem) > 0 {
+		rsKey, err = jwt.ParseRSAPublicKeyFromPEM(pem)
+		if err != nil {
+			return nil, fmt.Errorf("parse rs256 public key: %w", err)
+		}
+	}
+	return NewTokenVerifier([]byte(strings.TrimSpace(string(secret))), rsKey)
+}
+
+// Verify проверяем подпись, алгоритм и срок жизни токена, id пользователя берем из sub
+func (v *TokenVerifier) Verify(token string) (int64, error) {
+	var methods []string
+	if len(v.hsKey) > 0 {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	if v.rsKey != nil {
+		methods = append(methods, jwt.SigningMethodRS256.Alg())
+	}
+
+	claims := &jwt.RegisteredClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		// алгоритм уже проверен WithValidMethods, отдаем ключ под него
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); ok {
+			return v.hsKey, nil
+		}
+		return v.rsKey, nil
+	}, jwt.WithValidMethods(methods), jwt.WithExpirationRequired())
+	if err != nil {
+		return 0, err
+	}
+
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || userID <= 0 {
+		return 0, errors.New("invalid sub claim")
+	}
+	return userID, nil
+}
+
+// AuthMiddleware требует заголовок Authorization: Bearer <jwt>, без него или с плохим токеном отвечаем 401.
+// id пользователя из токена кладем в контекст запроса, дальше его видит chat.Service
+func AuthMiddleware(v *TokenVerifier, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if token == "" {
+			writeUnauthorized(w)
+			return
+		}
+		userID, err := v.Verify(token)
+		if err != nil {
+			writeUnauthorized(w)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(chat.WithUserID(r.Context(), userID)))
+	})
+}
+
+// bearerToken токен из Authorization: Bearer.
+// Браузер не умеет ставить заголовки на WebSocket и EventSource, поэтому для них принимаем еще query параметр access_token
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	if websocket.IsWebSocketUpgrade(r) || strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		return r.URL.Query().Get("access_token")
+	}
+	return ""
+}
+
+// Ответ 401 в обычном формате writeError
+func writeUnauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="chat-api"`)
+	writeError(w, http.StatusUnauthorized, "unauthorized")
+}
+
+// Читаем значение из переменной name или из файла по пути из name_FILE
+func envOrFile(name string) ([]byte, error) {
+	if v := os.Getenv(name); v != "" {
+		return []byte(v), nil
+	}
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", name+"_FILE", err)
+	}
+	return b, nil
+}
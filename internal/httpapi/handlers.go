@@ -4,6 +4,8 @@ import (
 	"errors"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"hitalent/internal/chat"
 )
@@ -35,30 +37,87 @@ func (a *API) CreateChat(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusCreated, c)
 }
 
+// ListChats GET /chats?limit=N&cursor=C&title=T&sort=created_at|activity
+func (a *API) ListChats(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	cq := chat.ChatListQuery{
+		Cursor: q.Get("cursor"),
+		Title:  q.Get("title"),
+	}
+	// Читаем query параметры, если не разобрались, возвращаем ошибку
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		cq.Limit = n
+	}
+	switch q.Get("sort") {
+	case "", "created_at":
+	case "activity":
+		cq.Activity = true
+	default:
+		writeError(w, http.StatusBadRequest, "invalid sort")
+		return
+	}
+
+	// вызываем сервис
+	page, err := a.svc.ListChats(r.Context(), cq)
+	if err != nil {
+		writeDomainError(w, err)
+		return
+	}
+
+	resp := struct {
+		Chats      []chat.ChatSummary `json:"chats"`
+		NextCursor string             `json:"next_cursor,omitempty"`
+	}{
+		Chats:      page.Chats,
+		NextCursor: page.NextCursor,
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
 // CreateMessage POST /chats/{id}/messages/
 func (a *API) CreateMessage(w http.ResponseWriter, r *http.Request, chatID int64) {
 	var req struct {
-		Text string `json:"text"`
+		Text          string  `json:"text"`
+		ClientID      string  `json:"client_id"`
+		ParentID      int64   `json:"parent_id"`
+		AttachmentIDs []int64 `json:"attachment_ids"`
 	}
 	// decodeJSON функция из json.go читает json из r.Body, парсит в req, иначе дает ошибку
 	if err := decodeJSON(w, r, &req); err != nil {
 		return
 	}
-	// вызываем сервис
-	m, err := a.svc.CreateMessage(r.Context(), chatID, req.Text)
+	// вызываем сервис, автором будет пользователь из токена
+	m, created, err := a.svc.CreateMessage(r.Context(), chatID, chat.NewMessage{
+		Text:          req.Text,
+		ClientID:      req.ClientID,
+		ParentID:      req.ParentID,
+		AttachmentIDs: req.AttachmentIDs,
+	})
 	if err != nil {
 		writeDomainError(w, err)
 		return
 	}
 
-	writeJSON(w, http.StatusCreated, m)
+	// повтор с тем же client_id отдает уже созданное сообщение
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, m)
 }
 
-// GetChat GET /chats/{id}?limit=N
+// GetChat GET /chats/{id}?limit=N&before=C&after=C
 func (a *API) GetChat(w http.ResponseWriter, r *http.Request, chatID int64) {
+	q := r.URL.Query()
 	limit := 0
 	// Читаем query параметры, если не число, возвращаем ошибку
-	if v := r.URL.Query().Get("limit"); v != "" {
+	if v := q.Get("limit"); v != "" {
 		n, err := strconv.Atoi(v)
 		if err != nil {
 			writeError(w, http.StatusBadRequest, "invalid limit")
@@ -67,20 +126,371 @@ func (a *API) GetChat(w http.ResponseWriter, r *http.Request, chatID int64) {
 		limit = n
 	}
 
-	// вызываем сервис, он проверит данные, проверит что чат существует и вернет последние limit сообщения, иначе ошибку
-	c, msgs, err := a.svc.GetChatWithMessages(r.Context(), chatID, limit)
+	// after_id или wait включают long-poll: ждем сообщений новее after_id
+	if q.Has("after_id") || q.Has("wait") {
+		a.waitChat(w, r, chatID, limit)
+		return
+	}
+
+	// вызываем сервис, он проверит данные, проверит что чат существует и вернет страницу сообщений, иначе ошибку
+	// закрепленные сообщения и непрочитанные сервис отдает вместе с чатом
+	view, page, err := a.svc.GetChatWithMessages(r.Context(), chatID, chat.PageQuery{
+		Limit:  limit,
+		Before: q.Get("before"),
+		After:  q.Get("after"),
+	})
+	if err != nil {
+		writeDomainError(w, err)
+		return
+	}
+
+	// формируем ответ и отдаем json, версию чата отдаем в ETag для последующего PATCH с If-Match
+	setETag(w, view.Chat)
+	resp := struct {
+		Chat *chat.Chat `json:"chat"`
+		chat.ReadState
+		Pinned     []chat.Pin     `json:"pinned"`
+		Messages   []chat.Message `json:"messages"`
+		NextCursor string         `json:"next_cursor,omitempty"`
+		PrevCursor string         `json:"prev_cursor,omitempty"`
+	}{
+		Chat:       view.Chat,
+		ReadState:  view.Read,
+		Pinned:     view.Pinned,
+		Messages:   page.Messages,
+		NextCursor: page.NextCursor,
+		PrevCursor: page.PrevCursor,
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Запас к ожиданию long-poll на запись ответа
+const longPollWriteSlack = 10 * time.Second
+
+// waitChat GET /chats/{id}?after_id=N&wait=30s
+// Отдаем сообщения с id больше after_id, а если их нет, держим запрос до нового сообщения или конца wait.
+// Ответ в том же формате, что и у GetChat, с закрепленными и непрочитанными, но без курсоров
+func (a *API) waitChat(w http.ResponseWriter, r *http.Request, chatID int64, limit int) {
+	q := r.URL.Query()
+	if q.Get("before") != "" || q.Get("after") != "" {
+		writeError(w, http.StatusBadRequest, "after_id cannot be combined with before/after")
+		return
+	}
+	// без after_id ждать нечего: ответом сразу стало бы начало истории, а не новые сообщения
+	if !q.Has("after_id") {
+		writeError(w, http.StatusBadRequest, "wait requires after_id")
+		return
+	}
+	afterID, ok := parseInt64(q.Get("after_id"))
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid after_id")
+		return
+	}
+	wait, ok := parseWait(q.Get("wait"))
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid wait")
+		return
+	}
+
+	// ожидание дольше WriteTimeout сервера, продлеваем дедлайн записи для этого запроса
+	if wait > 0 {
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + longPollWriteSlack))
+	}
+
+	view, msgs, err := a.svc.WaitChatMessages(r.Context(), chatID, chat.WaitQuery{
+		AfterID: afterID,
+		Limit:   limit,
+		Wait:    wait,
+	})
 	if err != nil {
 		writeDomainError(w, err)
 		return
 	}
 
-	// формируем ответ и отдаем json
+	setETag(w, view.Chat)
 	resp := struct {
-		Chat     *chat.Chat     `json:"chat"`
+		Chat *chat.Chat `json:"chat"`
+		chat.ReadState
+		Pinned   []chat.Pin     `json:"pinned"`
 		Messages []chat.Message `json:"messages"`
 	}{
-		Chat:     c,
-		Messages: msgs,
+		Chat:      view.Chat,
+		ReadState: view.Read,
+		Pinned:    view.Pinned,
+		Messages:  msgs,
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// parseWait длительность ожидания: "30s", "1m" или просто число секунд
+func parseWait(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, true
+	}
+	if n, err := strconv.Atoi(v); err == nil {
+		return time.Duration(n) * time.Second, true
+	}
+	d, err := time.ParseDuration(v)
+	return d, err == nil
+}
+
+// CreateMessagesBatch POST /chats/{id}/messages:batch
+// mode atomic (по умолчанию) создает все сообщения или ни одного, partial создает валидные и сообщает об ошибках по индексам.
+// partial с ошибками отвечает 207, чтобы клиент видел неудачу, не разбирая каждый элемент
+func (a *API) CreateMessagesBatch(w http.ResponseWriter, r *http.Request, chatID int64) {
+	var req struct {
+		Mode     string `json:"mode"`
+		Messages []struct {
+			Text     string `json:"text"`
+			ClientID string `json:"client_id"`
+		} `json:"messages"`
+	}
+	// decodeJSON функция из json.go читает json из r.Body, парсит в req, иначе дает ошибку
+	if err := decodeJSON(w, r, &req); err != nil {
+		return
+	}
+	var partial bool
+	switch req.Mode {
+	case "", "atomic":
+	case "partial":
+		partial = true
+	default:
+		writeError(w, http.StatusBadRequest, "invalid mode")
+		return
+	}
+
+	items := make([]chat.NewMessage, len(req.Messages))
+	for i, m := range req.Messages {
+		items[i] = chat.NewMessage{Text: m.Text, ClientID: m.ClientID}
+	}
+
+	// вызываем сервис, автором всех сообщений будет пользователь из токена
+	results, err := a.svc.CreateMessages(r.Context(), chatID, items, partial)
+	if err != nil && results == nil {
+		writeDomainError(w, err)
+		return
+	}
+
+	// результат по каждому сообщению: статус как у одиночного POST, сообщение или ошибка
+	type itemResult struct {
+		Index   int           `json:"index"`
+		Status  int           `json:"status"`
+		Message *chat.Message `json:"message,omitempty"`
+		Error   string        `json:"error,omitempty"`
+	}
+	out := make([]itemResult, 0, len(results))
+	failed := 0
+	for i, res := range results {
+		switch {
+		case res.Err != nil:
+			failed++
+			status, msg := domainErrorStatus(res.Err)
+			out = append(out, itemResult{Index: i, Status: status, Error: msg})
+		case res.Message != nil:
+			status := http.StatusOK
+			if res.Created {
+				status = http.StatusCreated
+			}
+			out = append(out, itemResult{Index: i, Status: status, Message: res.Message})
+		}
+	}
+
+	// atomic пачка с ошибками не создана, отдаем только ошибки по индексам
+	if err != nil {
+		status, msg := domainErrorStatus(err)
+		writeJSON(w, status, struct {
+			Error   string       `json:"error"`
+			Results []itemResult `json:"results"`
+		}{Error: msg, Results: out})
+		return
+	}
+	status := http.StatusOK
+	if failed > 0 {
+		status = http.StatusMultiStatus
+	}
+	writeJSON(w, status, struct {
+		Failed  int          `json:"failed"`
+		Results []itemResult `json:"results"`
+	}{Failed: failed, Results: out})
+}
+
+// MarkRead POST /chats/{id}/read
+// Body {"message_id": N} необязательный, без него чат отмечается прочитанным до последнего сообщения
+func (a *API) MarkRead(w http.ResponseWriter, r *http.Request, chatID int64) {
+	var req struct {
+		MessageID int64 `json:"message_id"`
+	}
+	// пустое тело тоже допустимо
+	if r.ContentLength != 0 {
+		if err := decodeJSON(w, r, &req); err != nil {
+			return
+		}
+	}
+	// вызываем сервис
+	st, err := a.svc.MarkRead(r.Context(), chatID, req.MessageID)
+	if err != nil {
+		writeDomainError(w, err)
+		return
+	}
+
+	resp := struct {
+		ChatID int64 `json:"chat_id"`
+		chat.ReadState
+	}{
+		ChatID:    chatID,
+		ReadState: *st,
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Typing POST /chats/{id}/typing
+// Отмечает, что пользователь печатает, ответ 204. Клиенту стоит повторять раз в несколько секунд, пока идет набор
+func (a *API) Typing(w http.ResponseWriter, r *http.Request, chatID int64) {
+	if err := a.svc.Typing(r.Context(), chatID); err != nil {
+		writeDomainError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Presence GET /chats/{id}/presence
+// Кто из участников сейчас онлайн или печатает
+func (a *API) Presence(w http.ResponseWriter, r *http.Request, chatID int64) {
+	list, err := a.svc.ListPresence(r.Context(), chatID)
+	if err != nil {
+		writeDomainError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"presence": list})
+}
+
+// UpdateChat PATCH /chats/{id}
+// If-Match с ETag из GET /chats/{id} защищает от перезаписи чужого изменения, при несовпадении 412
+func (a *API) UpdateChat(w http.ResponseWriter, r *http.Request, chatID int64) {
+	version, ok := parseIfMatch(r.Header.Get("If-Match"))
+	if !ok {
+		writeError(w, http.StatusPreconditionFailed, "precondition failed")
+		return
+	}
+
+	var req struct {
+		Title string `json:"title"`
+	}
+	// decodeJSON функция из json.go читает json из r.Body, парсит в req, иначе дает ошибку
+	if err := decodeJSON(w, r, &req); err != nil {
+		return
+	}
+	// вызываем сервис
+	c, err := a.svc.RenameChat(r.Context(), chatID, req.Title, version)
+	if err != nil {
+		writeDomainError(w, err)
+		return
+	}
+
+	setETag(w, c)
+	writeJSON(w, http.StatusOK, c)
+}
+
+// ListMessages GET /chats/{id}/messages?limit=N&before=C&after=C&since=T&until=T&order=asc|desc
+func (a *API) ListMessages(w http.ResponseWriter, r *http.Request, chatID int64) {
+	q := r.URL.Query()
+	var lq chat.ListQuery
+
+	// Читаем query параметры, если не разобрались, возвращаем ошибку
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		lq.Limit = n
+	}
+	lq.Before = q.Get("before")
+	lq.After = q.Get("after")
+
+	// даты в RFC3339, since включительно, until не включительно
+	var ok bool
+	if lq.Since, ok = parseTimeParam(w, r, "since"); !ok {
+		return
+	}
+	if lq.Until, ok = parseTimeParam(w, r, "until"); !ok {
+		return
+	}
+
+	switch q.Get("order") {
+	case "", "asc":
+	case "desc":
+		lq.Desc = true
+	default:
+		writeError(w, http.StatusBadRequest, "invalid order")
+		return
+	}
+
+	// вызываем сервис
+	page, err := a.svc.ListMessages(r.Context(), chatID, lq)
+	if err != nil {
+		writeDomainError(w, err)
+		return
+	}
+
+	resp := struct {
+		Messages   []chat.Message `json:"messages"`
+		NextCursor string         `json:"next_cursor,omitempty"`
+		PrevCursor string         `json:"prev_cursor,omitempty"`
+	}{
+		Messages:   page.Messages,
+		NextCursor: page.NextCursor,
+		PrevCursor: page.PrevCursor,
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// UpdateMessage PATCH /chats/{id}/messages/{msgID}
+func (a *API) UpdateMessage(w http.ResponseWriter, r *http.Request, chatID, msgID int64) {
+	var req struct {
+		Text string `json:"text"`
+	}
+	// decodeJSON функция из json.go читает json из r.Body, парсит в req, иначе дает ошибку
+	if err := decodeJSON(w, r, &req); err != nil {
+		return
+	}
+	// вызываем сервис
+	m, err := a.svc.EditMessage(r.Context(), chatID, msgID, req.Text)
+	if err != nil {
+		writeDomainError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, m)
+}
+
+// DeleteMessage DELETE /chats/{id}/messages/{msgID} возвращает 204
+func (a *API) DeleteMessage(w http.ResponseWriter, r *http.Request, chatID, msgID int64) {
+	// вызываем сервис
+	if err := a.svc.DeleteMessage(r.Context(), chatID, msgID); err != nil {
+		writeDomainError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MessageHistory GET /chats/{id}/messages/{msgID}/history
+func (a *API) MessageHistory(w http.ResponseWriter, r *http.Request, chatID, msgID int64) {
+	// вызываем сервис
+	m, edits, err := a.svc.MessageHistory(r.Context(), chatID, msgID)
+	if err != nil {
+		writeDomainError(w, err)
+		return
+	}
+
+	resp := struct {
+		Message *chat.Message      `json:"message"`
+		Edits   []chat.MessageEdit `json:"edits"`
+	}{
+		Message: m,
+		Edits:   edits,
 	}
 
 	writeJSON(w, http.StatusOK, resp)
@@ -96,14 +506,313 @@ func (a *API) DeleteChat(w http.ResponseWriter, r *http.Request, chatID int64) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// ListMembers GET /chats/{id}/members
+func (a *API) ListMembers(w http.ResponseWriter, r *http.Request, chatID int64) {
+	// вызываем сервис
+	members, err := a.svc.ListMembers(r.Context(), chatID)
+	if err != nil {
+		writeDomainError(w, err)
+		return
+	}
+
+	resp := struct {
+		Members []chat.Member `json:"members"`
+	}{
+		Members: members,
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// AddMember POST /chats/{id}/members, 201 для нового участника и 200 при смене роли
+func (a *API) AddMember(w http.ResponseWriter, r *http.Request, chatID int64) {
+	var req struct {
+		UserID int64  `json:"user_id"`
+		Role   string `json:"role"`
+	}
+	// decodeJSON функция из json.go читает json из r.Body, парсит в req, иначе дает ошибку
+	if err := decodeJSON(w, r, &req); err != nil {
+		return
+	}
+	// роль по умолчанию обычный участник
+	if req.Role == "" {
+		req.Role = string(chat.RoleMember)
+	}
+	// вызываем сервис
+	m, created, err := a.svc.AddMember(r.Context(), chatID, req.UserID, chat.Role(req.Role))
+	if err != nil {
+		writeDomainError(w, err)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, m)
+}
+
+// RemoveMember DELETE /chats/{id}/members/{userID} возвращает 204
+func (a *API) RemoveMember(w http.ResponseWriter, r *http.Request, chatID, userID int64) {
+	// вызываем сервис
+	if err := a.svc.RemoveMember(r.Context(), chatID, userID); err != nil {
+		writeDomainError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListReplies GET /chats/{id}/messages/{msgID}/replies
+// Ответы в треде по возрастанию (created_at, id), курсоры как у GET /chats/{id}/messages
+func (a *API) ListReplies(w http.ResponseWriter, r *http.Request, chatID, msgID int64) {
+	q := r.URL.Query()
+	pq := chat.PageQuery{
+		Before: q.Get("before"),
+		After:  q.Get("after"),
+	}
+	// Читаем query параметры, если не число, возвращаем ошибку
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		pq.Limit = n
+	}
+
+	// вызываем сервис
+	page, err := a.svc.ListReplies(r.Context(), chatID, msgID, pq)
+	if err != nil {
+		writeDomainError(w, err)
+		return
+	}
+
+	resp := struct {
+		Messages   []chat.Message `json:"messages"`
+		NextCursor string         `json:"next_cursor,omitempty"`
+		PrevCursor string         `json:"prev_cursor,omitempty"`
+	}{
+		Messages:   page.Messages,
+		NextCursor: page.NextCursor,
+		PrevCursor: page.PrevCursor,
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// AddReaction PUT /chats/{id}/messages/{msgID}/reactions/{emoji}
+// Возвращает счетчики реакций сообщения, 201 для новой реакции и 200, если она уже стояла
+func (a *API) AddReaction(w http.ResponseWriter, r *http.Request, chatID, msgID int64, emoji string) {
+	// вызываем сервис
+	counts, created, err := a.svc.AddReaction(r.Context(), chatID, msgID, emoji)
+	if err != nil {
+		writeDomainError(w, err)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	resp := struct {
+		Reactions []chat.ReactionCount `json:"reactions"`
+	}{
+		Reactions: counts,
+	}
+	writeJSON(w, status, resp)
+}
+
+// RemoveReaction DELETE /chats/{id}/messages/{msgID}/reactions/{emoji} возвращает 204
+func (a *API) RemoveReaction(w http.ResponseWriter, r *http.Request, chatID, msgID int64, emoji string) {
+	// вызываем сервис
+	if err := a.svc.RemoveReaction(r.Context(), chatID, msgID, emoji); err != nil {
+		writeDomainError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PinMessage PUT /chats/{id}/messages/{msgID}/pin
+// Возвращает закрепление, 201 для нового и 200, если сообщение уже было закреплено, 409 сверх предела
+func (a *API) PinMessage(w http.ResponseWriter, r *http.Request, chatID, msgID int64) {
+	// вызываем сервис
+	pin, created, err := a.svc.PinMessage(r.Context(), chatID, msgID)
+	if err != nil {
+		writeDomainError(w, err)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, pin)
+}
+
+// UnpinMessage DELETE /chats/{id}/messages/{msgID}/pin возвращает 204
+func (a *API) UnpinMessage(w http.ResponseWriter, r *http.Request, chatID, msgID int64) {
+	// вызываем сервис
+	if err := a.svc.UnpinMessage(r.Context(), chatID, msgID); err != nil {
+		writeDomainError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SearchMessages GET /chats/{id}/messages/search?q=
+func (a *API) SearchMessages(w http.ResponseWriter, r *http.Request, chatID int64) {
+	sq, ok := parseSearchQuery(w, r)
+	if !ok {
+		return
+	}
+	// вызываем сервис
+	page, err := a.svc.SearchChat(r.Context(), chatID, sq)
+	if err != nil {
+		writeDomainError(w, err)
+		return
+	}
+	writeSearchPage(w, page)
+}
+
+// Search GET /search?q= поиск по всем чатам вызывающего
+func (a *API) Search(w http.ResponseWriter, r *http.Request) {
+	sq, ok := parseSearchQuery(w, r)
+	if !ok {
+		return
+	}
+	// вызываем сервис
+	page, err := a.svc.Search(r.Context(), sq)
+	if err != nil {
+		writeDomainError(w, err)
+		return
+	}
+	writeSearchPage(w, page)
+}
+
+// Вспомогательная функция для чтения q, limit и cursor поиска, при ошибке сразу отвечаем 400
+func parseSearchQuery(w http.ResponseWriter, r *http.Request) (chat.SearchQuery, bool) {
+	q := r.URL.Query()
+	sq := chat.SearchQuery{
+		Q:      q.Get("q"),
+		Cursor: q.Get("cursor"),
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return sq, false
+		}
+		sq.Limit = n
+	}
+	return sq, true
+}
+
+func writeSearchPage(w http.ResponseWriter, page *chat.SearchPage) {
+	resp := struct {
+		Results    []chat.SearchHit `json:"results"`
+		NextCursor string           `json:"next_cursor,omitempty"`
+	}{
+		Results:    page.Results,
+		NextCursor: page.NextCursor,
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// CreateUser POST /users
+func (a *API) CreateUser(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	// decodeJSON функция из json.go читает json из r.Body, парсит в req, иначе дает ошибку
+	if err := decodeJSON(w, r, &req); err != nil {
+		return
+	}
+	// вызываем сервис
+	u, err := a.svc.CreateUser(r.Context(), req.Name)
+	if err != nil {
+		writeDomainError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, u)
+}
+
+// GetUser GET /users/{id}
+func (a *API) GetUser(w http.ResponseWriter, r *http.Request, userID int64) {
+	// вызываем сервис
+	u, err := a.svc.GetUser(r.Context(), userID)
+	if err != nil {
+		writeDomainError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, u)
+}
+
+// Вспомогательная функция для чтения времени из query в RFC3339, при ошибке сразу отвечаем 400
+func parseTimeParam(w http.ResponseWriter, r *http.Request, name string) (*time.Time, bool) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return nil, true
+	}
+	ts, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid "+name)
+		return nil, false
+	}
+	return &ts, true
+}
+
+// ETag чата это его версия в кавычках
+func setETag(w http.ResponseWriter, c *chat.Chat) {
+	w.Header().Set("ETag", `"`+strconv.FormatInt(c.Version, 10)+`"`)
+}
+
+// Разбираем If-Match: пустой заголовок или * значит без проверки версии (nil),
+// иначе ждем один сильный ETag из setETag. Слабые и битые ETag совпасть не могут, возвращаем false
+func parseIfMatch(v string) (*int64, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" || v == "*" {
+		return nil, true
+	}
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return nil, false
+	}
+	n, err := strconv.ParseInt(v[1:len(v)-1], 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	return &n, true
+}
+
 // Вспомогательная функция для перевода доменных ошибок в http статусы
 func writeDomainError(w http.ResponseWriter, err error) {
+	if errors.Is(err, chat.ErrUnauthenticated) {
+		writeUnauthorized(w)
+		return
+	}
+	status, msg := domainErrorStatus(err)
+	writeError(w, status, msg)
+}
+
+// domainErrorStatus HTTP статус и текст для доменной ошибки
+func domainErrorStatus(err error) (int, string) {
 	switch {
 	case errors.Is(err, chat.ErrValidation):
-		writeError(w, http.StatusBadRequest, err.Error())
+		return http.StatusBadRequest, err.Error()
+	case errors.Is(err, chat.ErrUnauthenticated):
+		return http.StatusUnauthorized, "unauthorized"
+	case errors.Is(err, chat.ErrForbidden):
+		return http.StatusForbidden, "forbidden"
 	case errors.Is(err, chat.ErrNotFound):
-		writeError(w, http.StatusNotFound, "not found")
+		return http.StatusNotFound, "not found"
+	case errors.Is(err, chat.ErrConflict):
+		return http.StatusConflict, err.Error()
+	case errors.Is(err, chat.ErrPreconditionFailed):
+		return http.StatusPreconditionFailed, "precondition failed"
+	case errors.Is(err, chat.ErrTooLarge):
+		return http.StatusRequestEntityTooLarge, err.Error()
 	default:
-		writeError(w, http.StatusInternalServerError, "internal error")
+		return http.StatusInternalServerError, "internal error"
 	}
 }
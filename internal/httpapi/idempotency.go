@@ -0,0 +1,155 @@
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"hitalent/internal/chat"
+	"hitalent/internal/idempotency"
+)
+
+// Ключ идемпотентности длиной до maxIdempotencyKey символов
+const maxIdempotencyKey = 255
+
+// captureWriter пишет ответ клиенту и заодно запоминает его для повторов
+type captureWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *captureWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// idempotentRoute запросы, для которых действует Idempotency-Key: POST /chats и POST /chats/{id}/messages
+func idempotentRoute(r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		return false
+	}
+	path := strings.Trim(r.URL.Path, "/")
+	if path == "chats" {
+		return true
+	}
+	rest, ok := strings.CutPrefix(path, "chats/")
+	if !ok {
+		return false
+	}
+	parts := strings.Split(rest, "/")
+	if len(parts) != 2 || parts[1] != "messages" {
+		return false
+	}
+	chatID, ok := parseInt64(parts[0])
+	return ok && chatID > 0
+}
+
+// IdempotencyMiddleware создание чата или сообщения с заголовком Idempotency-Key выполняется один раз.
+// Повтор с тем же ключом получает сохраненный ответ (с Idempotent-Replayed: true),
+// тот же ключ с другим запросом 422, повтор во время выполнения первого 409.
+// Ответы 5xx не сохраняем, такой запрос можно повторить с тем же ключом.
+// Ставится после AuthMiddleware: ключи у каждого пользователя свои
+func IdempotencyMiddleware(store idempotency.Store, ttl time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || !idempotentRoute(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			writeError(w, http.StatusBadRequest, "invalid Idempotency-Key")
+			return
+		}
+		userID, ok := chat.UserIDFromContext(r.Context())
+		if !ok {
+			writeUnauthorized(w)
+			return
+		}
+
+		// тело читаем для хеша и возвращаем обратно, лимит размера проверит decodeJSON
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxBodyBytes+1))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body")
+			return
+		}
+		if len(body) > maxBodyBytes {
+			// тело больше JSON-лимита отклонит decodeJSON, ключ под такой запрос не занимаем
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash := requestHash(r, body)
+
+		lease, rec, err := store.Reserve(r.Context(), userID, key, hash, ttl)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		if lease == "" {
+			switch {
+			case rec.RequestHash != hash:
+				writeError(w, http.StatusUnprocessableEntity, "Idempotency-Key reused with a different request")
+			case rec.Status == 0:
+				writeError(w, http.StatusConflict, "request with this Idempotency-Key is in progress")
+			default:
+				if rec.ContentType != "" {
+					w.Header().Set("Content-Type", rec.ContentType)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(rec.Status)
+				_, _ = w.Write(rec.Body)
+			}
+			return
+		}
+
+		cw := &captureWriter{ResponseWriter: w}
+		// если ответ не сохранили (5xx или ошибка базы), освобождаем ключ для повтора
+		completed := false
+		defer func() {
+			if !completed {
+				_ = store.Release(context.WithoutCancel(r.Context()), userID, key, lease)
+			}
+		}()
+
+		next.ServeHTTP(cw, r)
+
+		if cw.status == 0 || cw.status >= http.StatusInternalServerError {
+			return
+		}
+		err = store.Complete(context.WithoutCancel(r.Context()), userID, key, lease, idempotency.Record{
+			RequestHash: hash,
+			Status:      cw.status,
+			ContentType: cw.Header().Get("Content-Type"),
+			Body:        cw.body.Bytes(),
+		})
+		completed = err == nil
+	})
+}
+
+// requestHash хеш метода, пути и тела: тот же ключ на другом методе API тоже считается другим запросом
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
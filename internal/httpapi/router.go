@@ -9,9 +9,36 @@ import (
 // Handler Интерфейс для удобства тестирования
 type Handler interface {
 	CreateChat(w http.ResponseWriter, r *http.Request)
+	ListChats(w http.ResponseWriter, r *http.Request)
 	CreateMessage(w http.ResponseWriter, r *http.Request, chatID int64)
+	CreateMessagesBatch(w http.ResponseWriter, r *http.Request, chatID int64)
+	ListMessages(w http.ResponseWriter, r *http.Request, chatID int64)
 	GetChat(w http.ResponseWriter, r *http.Request, chatID int64)
+	UpdateChat(w http.ResponseWriter, r *http.Request, chatID int64)
 	DeleteChat(w http.ResponseWriter, r *http.Request, chatID int64)
+	MarkRead(w http.ResponseWriter, r *http.Request, chatID int64)
+	Typing(w http.ResponseWriter, r *http.Request, chatID int64)
+	Presence(w http.ResponseWriter, r *http.Request, chatID int64)
+	UploadAttachment(w http.ResponseWriter, r *http.Request, chatID int64)
+	GetAttachment(w http.ResponseWriter, r *http.Request, chatID, attID int64)
+	GetThumbnail(w http.ResponseWriter, r *http.Request, chatID, attID int64)
+	UpdateMessage(w http.ResponseWriter, r *http.Request, chatID, msgID int64)
+	DeleteMessage(w http.ResponseWriter, r *http.Request, chatID, msgID int64)
+	MessageHistory(w http.ResponseWriter, r *http.Request, chatID, msgID int64)
+	ListReplies(w http.ResponseWriter, r *http.Request, chatID, msgID int64)
+	AddReaction(w http.ResponseWriter, r *http.Request, chatID, msgID int64, emoji string)
+	RemoveReaction(w http.ResponseWriter, r *http.Request, chatID, msgID int64, emoji string)
+	PinMessage(w http.ResponseWriter, r *http.Request, chatID, msgID int64)
+	UnpinMessage(w http.ResponseWriter, r *http.Request, chatID, msgID int64)
+	SearchMessages(w http.ResponseWriter, r *http.Request, chatID int64)
+	Search(w http.ResponseWriter, r *http.Request)
+	ListMembers(w http.ResponseWriter, r *http.Request, chatID int64)
+	AddMember(w http.ResponseWriter, r *http.Request, chatID int64)
+	RemoveMember(w http.ResponseWriter, r *http.Request, chatID, userID int64)
+	ChatSocket(w http.ResponseWriter, r *http.Request, chatID int64)
+	ChatEvents(w http.ResponseWriter, r *http.Request, chatID int64)
+	CreateUser(w http.ResponseWriter, r *http.Request)
+	GetUser(w http.ResponseWriter, r *http.Request, userID int64)
 }
 
 // NewRouter используем стандартный роутер из Go и будем матчить пути по префиксу или точному совпадению
@@ -25,6 +52,9 @@ func NewRouter(h Handler) http.Handler {
 		}
 
 		switch r.Method {
+		case http.MethodGet:
+			h.ListChats(w, r)
+			return
 		case http.MethodPost:
 			h.CreateChat(w, r)
 			return
@@ -40,9 +70,13 @@ func NewRouter(h Handler) http.Handler {
 		path := strings.TrimPrefix(r.URL.Path, "/chats/")
 		path = strings.Trim(path, "/")
 
-		// если /chats/ обрабатываем как создание чата
+		// если /chats/ обрабатываем как создание или список чатов
 		if path == "" {
-			if r.Method == http.MethodPost {
+			switch r.Method {
+			case http.MethodGet:
+				h.ListChats(w, r)
+				return
+			case http.MethodPost:
 				h.CreateChat(w, r)
 				return
 			}
@@ -70,6 +104,9 @@ func NewRouter(h Handler) http.Handler {
 			case http.MethodGet:
 				h.GetChat(w, r, chatID)
 				return
+			case http.MethodPatch:
+				h.UpdateChat(w, r, chatID)
+				return
 			case http.MethodDelete:
 				h.DeleteChat(w, r, chatID)
 				return
@@ -79,24 +116,271 @@ func NewRouter(h Handler) http.Handler {
 			}
 		}
 
-		// /chats/{id}/messages
-		if len(parts) == 2 && parts[1] == "messages" {
-			switch r.Method {
-			case http.MethodPost:
-				h.CreateMessage(w, r, chatID)
+		// /chats/{id}/... разбираем по второму сегменту
+		switch parts[1] {
+		case "messages":
+			routeMessages(h, w, r, chatID, parts[2:])
+		case "messages:batch":
+			// /chats/{id}/messages:batch
+			if len(parts) != 2 {
+				http.NotFound(w, r)
 				return
-			default:
+			}
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			h.CreateMessagesBatch(w, r, chatID)
+		case "read":
+			// /chats/{id}/read
+			if len(parts) != 2 {
+				http.NotFound(w, r)
+				return
+			}
+			if r.Method != http.MethodPost {
 				w.WriteHeader(http.StatusMethodNotAllowed)
 				return
 			}
+			h.MarkRead(w, r, chatID)
+		case "typing":
+			// /chats/{id}/typing
+			if len(parts) != 2 {
+				http.NotFound(w, r)
+				return
+			}
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			h.Typing(w, r, chatID)
+		case "presence":
+			// /chats/{id}/presence
+			if len(parts) != 2 {
+				http.NotFound(w, r)
+				return
+			}
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			h.Presence(w, r, chatID)
+		case "attachments":
+			routeAttachments(h, w, r, chatID, parts[2:])
+		case "members":
+			routeMembers(h, w, r, chatID, parts[2:])
+		case "ws", "events":
+			// /chats/{id}/ws и /chats/{id}/events
+			if len(parts) != 2 {
+				http.NotFound(w, r)
+				return
+			}
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			if parts[1] == "ws" {
+				h.ChatSocket(w, r, chatID)
+				return
+			}
+			h.ChatEvents(w, r, chatID)
+		default:
+			http.NotFound(w, r)
 		}
+	})
 
-		http.NotFound(w, r)
+	// /search поиск сообщений по всем чатам пользователя
+	mux.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		h.Search(w, r)
+	})
+
+	// /users создание пользователя
+	mux.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		h.CreateUser(w, r)
+	})
+
+	// обработчик для /users/ и /users/{id}
+	mux.HandleFunc("/users/", func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/users/"), "/")
+
+		// /users/ создание пользователя
+		if path == "" {
+			if r.Method == http.MethodPost {
+				h.CreateUser(w, r)
+				return
+			}
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		// /users/{id}
+		userID, ok := parseInt64(path)
+		if !ok || userID <= 0 {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		h.GetUser(w, r, userID)
 	})
 
 	return mux
 }
 
+// routeMessages обработчик для /chats/{id}/messages, rest это сегменты после messages
+func routeMessages(h Handler, w http.ResponseWriter, r *http.Request, chatID int64, rest []string) {
+	// /chats/{id}/messages
+	if len(rest) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			h.ListMessages(w, r, chatID)
+		case http.MethodPost:
+			h.CreateMessage(w, r, chatID)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	// /chats/{id}/messages/search
+	if len(rest) == 1 && rest[0] == "search" {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		h.SearchMessages(w, r, chatID)
+		return
+	}
+
+	// Парсим id сообщения так же, как id чата
+	msgID, ok := parseInt64(rest[0])
+	if !ok || msgID <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	// /chats/{id}/messages/{msgID}
+	if len(rest) == 1 {
+		switch r.Method {
+		case http.MethodPatch:
+			h.UpdateMessage(w, r, chatID, msgID)
+		case http.MethodDelete:
+			h.DeleteMessage(w, r, chatID, msgID)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	// /chats/{id}/messages/{msgID}/history и /chats/{id}/messages/{msgID}/replies
+	if len(rest) == 2 && (rest[1] == "history" || rest[1] == "replies") {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if rest[1] == "history" {
+			h.MessageHistory(w, r, chatID, msgID)
+			return
+		}
+		h.ListReplies(w, r, chatID, msgID)
+		return
+	}
+
+	// /chats/{id}/messages/{msgID}/pin
+	if len(rest) == 2 && rest[1] == "pin" {
+		switch r.Method {
+		case http.MethodPut:
+			h.PinMessage(w, r, chatID, msgID)
+		case http.MethodDelete:
+			h.UnpinMessage(w, r, chatID, msgID)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	// /chats/{id}/messages/{msgID}/reactions/{emoji}, эмодзи в пути уже раскодирован из %XX
+	if len(rest) == 3 && rest[1] == "reactions" {
+		switch r.Method {
+		case http.MethodPut:
+			h.AddReaction(w, r, chatID, msgID, rest[2])
+		case http.MethodDelete:
+			h.RemoveReaction(w, r, chatID, msgID, rest[2])
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	http.NotFound(w, r)
+}
+
+// routeAttachments обработчик для /chats/{id}/attachments, /chats/{id}/attachments/{attID} и его /thumbnail
+func routeAttachments(h Handler, w http.ResponseWriter, r *http.Request, chatID int64, rest []string) {
+	// /chats/{id}/attachments
+	if len(rest) == 0 {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		h.UploadAttachment(w, r, chatID)
+		return
+	}
+
+	// /chats/{id}/attachments/{attID} и /chats/{id}/attachments/{attID}/thumbnail
+	attID, ok := parseInt64(rest[0])
+	if !ok || attID <= 0 || len(rest) > 2 || (len(rest) == 2 && rest[1] != "thumbnail") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if len(rest) == 2 {
+		h.GetThumbnail(w, r, chatID, attID)
+		return
+	}
+	h.GetAttachment(w, r, chatID, attID)
+}
+
+// routeMembers обработчик для /chats/{id}/members и /chats/{id}/members/{userID}
+func routeMembers(h Handler, w http.ResponseWriter, r *http.Request, chatID int64, rest []string) {
+	// /chats/{id}/members
+	if len(rest) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			h.ListMembers(w, r, chatID)
+		case http.MethodPost:
+			h.AddMember(w, r, chatID)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	// /chats/{id}/members/{userID}
+	userID, ok := parseInt64(rest[0])
+	if !ok || userID <= 0 || len(rest) > 1 {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	h.RemoveMember(w, r, chatID, userID)
+}
+
 // Функция для обработки ошибок при переводе id
 func parseInt64(s string) (int64, bool) {
 	v, err := strconv.ParseInt(s, 10, 64)
@@ -0,0 +1,135 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"hitalent/internal/chat"
+)
+
+// Раз в sseHeartbeat шлем комментарий, чтобы прокси не закрывали тихое соединение
+const sseHeartbeat = 20 * time.Second
+
+// ChatEvents GET /chats/{id}/events
+// Поток событий чата в формате Server-Sent Events. id события это id сообщения у message.created,
+// поэтому переподключившийся клиент присылает Last-Event-ID и получает все сообщения, созданные после него
+func (a *API) ChatEvents(w http.ResponseWriter, r *http.Request, chatID int64) {
+	lastID, ok := parseLastEventID(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid Last-Event-ID")
+		return
+	}
+
+	// подписываемся до чтения пропущенного, чтобы не потерять сообщения между чтением и подпиской
+	sub, err := a.svc.Subscribe(r.Context(), chatID)
+	if err != nil {
+		writeDomainError(w, err)
+		return
+	}
+	defer sub.Close()
+	userID, _ := chat.UserIDFromContext(r.Context())
+
+	// поток живет дольше WriteTimeout сервера, снимаем дедлайн записи для этого запроса
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprint(w, "retry: 3000\n\n")
+
+	// дочитываем пропущенное страницами, пока не догоним. Эти же сообщения могут прийти и живыми событиями
+	// из подписки, поэтому запоминаем, какие id уже ушли. Сравнивать с наибольшим отправленным id нельзя:
+	// id выдаются до коммита, и сообщение с меньшим id может закоммититься позже
+	replayed := make(map[int64]bool)
+	if lastID > 0 {
+		after := lastID
+		for {
+			msgs, err := a.svc.MessagesAfterID(r.Context(), chatID, after, 100)
+			if err != nil {
+				return
+			}
+			for i := range msgs {
+				ev := chat.Event{Type: chat.EventMessageCreated, ChatID: chatID, MessageID: msgs[i].ID, Message: &msgs[i]}
+				if writeSSE(w, ev) != nil {
+					return
+				}
+				replayed[msgs[i].ID] = true
+				after = msgs[i].ID
+			}
+			if len(msgs) < 100 {
+				break
+			}
+		}
+	}
+	if rc.Flush() != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case ev, ok := <-sub.Events():
+			if !ok {
+				// медленный клиент: закрываем поток, он переподключится с Last-Event-ID
+				return
+			}
+			// это сообщение уже ушло при дочитывании, message.created о нем приходит один раз
+			if ev.Type == chat.EventMessageCreated && replayed[ev.MessageID] {
+				delete(replayed, ev.MessageID)
+				continue
+			}
+			if writeSSE(w, ev) != nil || rc.Flush() != nil {
+				return
+			}
+			if ev.Type == chat.EventChatDeleted || removedFrom(ev, userID) {
+				return
+			}
+		case <-heartbeat.C:
+			a.svc.KeepOnline(r.Context(), chatID)
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Пишем одно событие SSE, id только у message.created
+func writeSSE(w http.ResponseWriter, ev chat.Event) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	if ev.Type == chat.EventMessageCreated {
+		b.WriteString("id: " + strconv.FormatInt(ev.MessageID, 10) + "\n")
+	}
+	b.WriteString("event: " + ev.Type + "\n")
+	b.WriteString("data: ")
+	b.Write(data)
+	b.WriteString("\n\n")
+	_, err = fmt.Fprint(w, b.String())
+	return err
+}
+
+// Last-Event-ID из заголовка (его шлет EventSource при переподключении) или из query last_event_id
+func parseLastEventID(r *http.Request) (int64, bool) {
+	v := r.Header.Get("Last-Event-ID")
+	if v == "" {
+		v = r.URL.Query().Get("last_event_id")
+	}
+	if v == "" {
+		return 0, true
+	}
+	id, ok := parseInt64(strings.TrimSpace(v))
+	return id, ok && id >= 0
+}
@@ -0,0 +1,105 @@
+package httpapi
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"hitalent/internal/chat"
+)
+
+// Таймауты WebSocket соединения
+const (
+	wsWriteWait  = 10 * time.Second    // на запись одного кадра
+	wsPongWait   = 60 * time.Second    // клиент должен ответить на ping за это время
+	wsPingPeriod = wsPongWait * 9 / 10 // ping шлем чаще, чем ждем pong
+	wsMaxMessage = 4 << 10             // клиент нам ничего кроме служебных кадров не шлет
+)
+
+// Проверка Origin по умолчанию: браузер с чужого сайта не подключится
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+// ChatSocket GET /chats/{id}/ws
+// Переключаем соединение на WebSocket и шлем в него события чата в JSON, по одному событию на кадр
+func (a *API) ChatSocket(w http.ResponseWriter, r *http.Request, chatID int64) {
+	// подписываемся до апгрейда, чтобы ошибки доступа ушли обычным JSON ответом
+	sub, err := a.svc.Subscribe(r.Context(), chatID)
+	if err != nil {
+		writeDomainError(w, err)
+		return
+	}
+	defer sub.Close()
+	userID, _ := chat.UserIDFromContext(r.Context())
+
+	// Upgrade сам отвечает клиенту ошибкой, если апгрейд не удался
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer func() { _ = conn.Close() }()
+
+	// читаем соединение в отдельной горутине: так обрабатываются pong и close от клиента
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		conn.SetReadLimit(wsMaxMessage)
+		_ = conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+
+	for {
+		select {
+		case ev, ok := <-sub.Events():
+			if !ok {
+				// хаб закрыл подписку: клиент не успевал читать свой буфер
+				writeClose(conn, websocket.CloseTryAgainLater, "slow consumer")
+				return
+			}
+			_ = conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteJSON(ev); err != nil {
+				return
+			}
+			if ev.Type == chat.EventChatDeleted {
+				writeClose(conn, websocket.CloseNormalClosure, "chat deleted")
+				return
+			}
+			if removedFrom(ev, userID) {
+				writeClose(conn, websocket.ClosePolicyViolation, "removed from chat")
+				return
+			}
+		case <-ping.C:
+			a.svc.KeepOnline(r.Context(), chatID)
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// removedFrom событие об удалении из чата самого подписчика, после него события чата ему больше не положены
+func removedFrom(ev chat.Event, userID int64) bool {
+	return ev.Type == chat.EventMemberRemoved && ev.UserID == userID
+}
+
+// Отправляем close кадр с кодом и причиной, ошибку игнорируем, соединение все равно закрываем
+func writeClose(conn *websocket.Conn, code int, reason string) {
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteWait))
+}
@@ -0,0 +1,26 @@
+package idempotency
+
+import (
+	"context"
+	"time"
+)
+
+// Record сохраненный ответ на запрос с Idempotency-Key. Status 0 значит, что запрос еще выполняется
+type Record struct {
+	RequestHash string
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// Store хранит ответы по ключам идемпотентности, ключи живут ttl и видны только своему пользователю.
+// Реализация в storage, использует httpapi.IdempotencyMiddleware
+type Store interface {
+	// Reserve занимает ключ под запрос с хешем hash и возвращает lease, которым потом завершают или освобождают ключ.
+	// Если ключ уже занят, не истек и не брошен незавершенным, lease пустой, а rec его запись
+	Reserve(ctx context.Context, userID int64, key, hash string, ttl time.Duration) (lease string, rec *Record, err error)
+	// Complete сохраняет ответ, если ключ все еще занят по lease
+	Complete(ctx context.Context, userID int64, key, lease string, rec Record) error
+	// Release освобождает ключ, занятый по lease, чтобы запрос можно было повторить
+	Release(ctx context.Context, userID int64, key, lease string) error
+}
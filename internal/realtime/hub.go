@@ -0,0 +1,95 @@
+package realtime
+
+import (
+	"sync"
+
+	"hitalent/internal/chat"
+)
+
+// Hub раздает события чатов подписчикам внутри одного процесса.
+// У каждого подписчика свой буфер, кто не успевает его разбирать, того отключаем, чтобы не тормозить остальных
+type Hub struct {
+	mu     sync.RWMutex
+	subs   map[int64]map[*subscription]struct{}
+	buffer int
+}
+
+// NewHub buffer размер буфера событий на одного подписчика
+func NewHub(buffer int) *Hub {
+	if buffer < 1 {
+		buffer = 1
+	}
+	return &Hub{
+		subs:   make(map[int64]map[*subscription]struct{}),
+		buffer: buffer,
+	}
+}
+
+// Publish отправляем событие всем подписчикам чата, не блокируясь на медленных
+func (h *Hub) Publish(ev chat.Event) {
+	var slow []*subscription
+
+	// отправка идет под RLock, закрытие канала только под Lock, поэтому в закрытый канал никто не пишет
+	h.mu.RLock()
+	for sub := range h.subs[ev.ChatID] {
+		select {
+		case sub.ch <- ev:
+		default:
+			slow = append(slow, sub)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, sub := range slow {
+		h.remove(sub)
+	}
+}
+
+// Subscribe подписываемся на события чата
+func (h *Hub) Subscribe(chatID int64) chat.Subscription {
+	sub := &subscription{
+		hub:    h,
+		chatID: chatID,
+		ch:     make(chan chat.Event, h.buffer),
+	}
+
+	h.mu.Lock()
+	if h.subs[chatID] == nil {
+		h.subs[chatID] = make(map[*subscription]struct{})
+	}
+	h.subs[chatID][sub] = struct{}{}
+	h.mu.Unlock()
+
+	return sub
+}
+
+// remove убираем подписчика и закрываем его канал, повторный вызов ничего не делает
+func (h *Hub) remove(sub *subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	subs := h.subs[sub.chatID]
+	if _, ok := subs[sub]; !ok {
+		return
+	}
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(h.subs, sub.chatID)
+	}
+	close(sub.ch)
+}
+
+// subscription подписка одного клиента на один чат
+type subscription struct {
+	hub    *Hub
+	chatID int64
+	ch     chan chat.Event
+}
+
+func (s *subscription) Events() <-chan chat.Event {
+	return s.ch
+}
+
+func (s *subscription) Close() {
+	s.hub.remove(s)
+}
@@ -0,0 +1,122 @@
+package realtime
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"hitalent/internal/chat"
+)
+
+// Presence хранит онлайн и "печатает" участников в памяти процесса.
+// Истекшие записи вычищаем при обращении к чату, а чаты, к которым больше не обращаются, чистит Sweep
+type Presence struct {
+	mu    sync.Mutex
+	chats map[int64]map[int64]*presenceEntry
+	now   func() time.Time
+}
+
+// presenceEntry до какого момента пользователь онлайн и печатает
+type presenceEntry struct {
+	online time.Time
+	typing time.Time
+}
+
+func NewPresence() *Presence {
+	return &Presence{
+		chats: make(map[int64]map[int64]*presenceEntry),
+		now:   time.Now,
+	}
+}
+
+// Touch продлеваем состояние kind до now+ttl, раньше уже выставленного срока не сдвигаем
+func (p *Presence) Touch(chatID, userID int64, kind chat.PresenceKind, ttl time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	p.prune(chatID, now)
+
+	users := p.chats[chatID]
+	if users == nil {
+		users = make(map[int64]*presenceEntry)
+		p.chats[chatID] = users
+	}
+	e := users[userID]
+	if e == nil {
+		e = &presenceEntry{}
+		users[userID] = e
+	}
+
+	until := now.Add(ttl)
+	switch kind {
+	case chat.PresenceOnline:
+		if until.After(e.online) {
+			e.online = until
+		}
+	case chat.PresenceTyping:
+		if until.After(e.typing) {
+			e.typing = until
+		}
+	}
+}
+
+// List живые записи чата по возрастанию user_id
+func (p *Presence) List(chatID int64) []chat.Presence {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	p.prune(chatID, now)
+
+	out := make([]chat.Presence, 0, len(p.chats[chatID]))
+	for userID, e := range p.chats[chatID] {
+		out = append(out, chat.Presence{
+			UserID: userID,
+			Online: e.online.After(now),
+			Typing: e.typing.After(now),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].UserID < out[j].UserID })
+	return out
+}
+
+// Sweep раз в every вычищаем истекшие записи во всех чатах, блокирует до отмены ctx
+func (p *Presence) Sweep(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		p.mu.Lock()
+		now := p.now()
+		for chatID := range p.chats {
+			p.prune(chatID, now)
+		}
+		p.mu.Unlock()
+	}
+}
+
+// Len сколько чатов сейчас держим в памяти
+func (p *Presence) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.chats)
+}
+
+// prune убираем записи, у которых истекло все, и пустой чат целиком. Вызывать под mu
+func (p *Presence) prune(chatID int64, now time.Time) {
+	users := p.chats[chatID]
+	for userID, e := range users {
+		if !e.online.After(now) && !e.typing.After(now) {
+			delete(users, userID)
+		}
+	}
+	if users != nil && len(users) == 0 {
+		delete(p.chats, chatID)
+	}
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"hitalent/internal/idempotency"
+)
+
+// idempotencyLease сколько держим незавершенный ключ. Ключи бывают только у POST /chats и POST /chats/{id}/messages,
+// дольше WriteTimeout сервера (10s) такие запросы не живут, поэтому ключ в статусе 0 старше аренды оставил
+// упавший или убитый запрос, и повтор может его занять. Даже если исходный запрос еще жив, его lease уже не совпадет,
+// и записи нового владельца он не тронет
+const idempotencyLease = time.Minute
+
+// IdempotencyStore ключи идемпотентности в таблице idempotency_keys
+type IdempotencyStore struct {
+	db *gorm.DB
+}
+
+func NewIdempotencyStore(db *gorm.DB) *IdempotencyStore {
+	return &IdempotencyStore{db: db}
+}
+
+// Строка таблицы idempotency_keys
+type idempotencyKey struct {
+	UserID      int64  `gorm:"column:user_id"`
+	Key         string `gorm:"column:key"`
+	RequestHash string `gorm:"column:request_hash"`
+	Status      int    `gorm:"column:status"`
+	ContentType string `gorm:"column:content_type"`
+	Body        []byte `gorm:"column:body"`
+}
+
+// Reserve вставляем ключ или занимаем истекший либо брошенный незавершенным дольше аренды, каждый раз с новым lease.
+// Если ключ живой, читаем его запись. Между вставкой и чтением ключ могли освободить, тогда пробуем еще раз
+func (s *IdempotencyStore) Reserve(ctx context.Context, userID int64, key, hash string, ttl time.Duration) (string, *idempotency.Record, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, fmt.Errorf("reserve idempotency key: %w", err)
+	}
+	lease := hex.EncodeToString(b)
+
+	for attempt := 0; attempt < 3; attempt++ {
+		res := s.db.WithContext(ctx).Exec(`
+INSERT INTO idempotency_keys (user_id, key, lease_id, request_hash, expires_at)
+VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (user_id, key) DO UPDATE
+SET lease_id = EXCLUDED.lease_id, request_hash = EXCLUDED.request_hash, status = 0, content_type = '', body = NULL,
+    created_at = NOW(), expires_at = EXCLUDED.expires_at
+WHERE idempotency_keys.expires_at < NOW()
+   OR (idempotency_keys.status = 0 AND idempotency_keys.created_at < NOW() - make_interval(secs => ?))`,
+			userID, key, lease, hash, time.Now().Add(ttl), idempotencyLease.Seconds())
+		if res.Error != nil {
+			return "", nil, fmt.Errorf("reserve idempotency key: %w", res.Error)
+		}
+		if res.RowsAffected == 1 {
+			return lease, nil, nil
+		}
+
+		var row idempotencyKey
+		err := s.db.WithContext(ctx).
+			Table("idempotency_keys").
+			Where("user_id = ? AND key = ?", userID, key).
+			Take(&row).
+			Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("get idempotency key: %w", err)
+		}
+		return "", &idempotency.Record{
+			RequestHash: row.RequestHash,
+			Status:      row.Status,
+			ContentType: row.ContentType,
+			Body:        row.Body,
+		}, nil
+	}
+	return "", nil, errors.New("reserve idempotency key: key keeps changing")
+}
+
+// Complete сохраняем ответ в ключ, если он все еще занят по lease.
+// Ключ, который после аренды занял повтор, исходный запрос уже не перезапишет
+func (s *IdempotencyStore) Complete(ctx context.Context, userID int64, key, lease string, rec idempotency.Record) error {
+	err := s.db.WithContext(ctx).
+		Table("idempotency_keys").
+		Where("user_id = ? AND key = ? AND lease_id = ? AND status = 0", userID, key, lease).
+		Updates(map[string]any{
+			"status":       rec.Status,
+			"content_type": rec.ContentType,
+			"body":         rec.Body,
+		}).
+		Error
+	if err != nil {
+		return fmt.Errorf("complete idempotency key: %w", err)
+	}
+	return nil
+}
+
+// Release удаляем незавершенный ключ, занятый по lease
+func (s *IdempotencyStore) Release(ctx context.Context, userID int64, key, lease string) error {
+	err := s.db.WithContext(ctx).
+		Exec("DELETE FROM idempotency_keys WHERE user_id = ? AND key = ? AND lease_id = ? AND status = 0", userID, key, lease).
+		Error
+	if err != nil {
+		return fmt.Errorf("release idempotency key: %w", err)
+	}
+	return nil
+}
+
+// PurgeExpired удаляем истекшие ключи, возвращаем сколько удалили
+func (s *IdempotencyStore) PurgeExpired(ctx context.Context) (int64, error) {
+	res := s.db.WithContext(ctx).Exec("DELETE FROM idempotency_keys WHERE expires_at < NOW()")
+	if res.Error != nil {
+		return 0, fmt.Errorf("purge idempotency keys: %w", res.Error)
+	}
+	return res.RowsAffected, nil
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"gorm.io/gorm"
+
+	"hitalent/internal/chat"
+)
+
+// EventsChannel канал LISTEN/NOTIFY с событиями чатов
+const EventsChannel = "chat_events"
+
+// Пауза перед переподключением слушателя растет до listenMaxBackoff
+const (
+	listenMinBackoff = time.Second
+	listenMaxBackoff = 30 * time.Second
+)
+
+// PGNotifier рассылает события чатов между репликами API через pg_notify.
+// Пишет в транзакции записи, а слушает на отдельном соединении вне пула GORM
+type PGNotifier struct {
+	dsn    string
+	origin string
+	log    *slog.Logger
+}
+
+// notification полезная нагрузка NOTIFY. Текст сообщения не кладем: лимит payload 8000 байт,
+// получатель перечитывает сообщение из базы. origin отличает свои уведомления от чужих
+type notification struct {
+	Origin    string `json:"origin"`
+	Type      string `json:"type"`
+	ChatID    int64  `json:"chat_id"`
+	MessageID int64  `json:"message_id,omitempty"`
+	UserID    int64  `json:"user_id,omitempty"`
+}
+
+func NewPGNotifier(dsn string, log *slog.Logger) *PGNotifier {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return &PGNotifier{dsn: dsn, origin: hex.EncodeToString(b), log: log}
+}
+
+// NotifyTx pg_notify в транзакции tx, уведомление уйдет слушателям после коммита
+func (n *PGNotifier) NotifyTx(tx *gorm.DB, ev chat.Event) error {
+	payload, err := json.Marshal(notification{
+		Origin:    n.origin,
+		Type:      ev.Type,
+		ChatID:    ev.ChatID,
+		MessageID: ev.MessageID,
+		UserID:    ev.UserID,
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Exec("SELECT pg_notify(?, ?)", EventsChannel, string(payload)).Error
+}
+
+// Listen слушает EventsChannel и передает в handle события других реплик.
+// Свои уведомления пропускаем: локальные подписчики уже получили событие от Service.
+// Блокирует до отмены ctx, при обрыве соединения переподключается.
+// Уведомления за время разрыва теряются, клиенты дочитывают их по Last-Event-ID или after_id
+func (n *PGNotifier) Listen(ctx context.Context, handle func(context.Context, chat.Event)) {
+	backoff := listenMinBackoff
+	for {
+		connected, err := n.listenOnce(ctx, handle)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = listenMinBackoff
+		}
+		n.log.Warn("pg listener disconnected", "err", err, "retry_in", backoff)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, listenMaxBackoff)
+	}
+}
+
+func (n *PGNotifier) listenOnce(ctx context.Context, handle func(context.Context, chat.Event)) (bool, error) {
+	conn, err := pgx.Connect(ctx, n.dsn)
+	if err != nil {
+		return false, fmt.Errorf("connect listener: %w", err)
+	}
+	defer func() { _ = conn.Close(context.Background()) }()
+
+	if _, err := conn.Exec(ctx, "LISTEN "+EventsChannel); err != nil {
+		return false, fmt.Errorf("listen: %w", err)
+	}
+	n.log.Info("pg listener started", "channel", EventsChannel)
+
+	for {
+		nt, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return true, fmt.Errorf("wait notification: %w", err)
+		}
+
+		var p notification
+		if err := json.Unmarshal([]byte(nt.Payload), &p); err != nil {
+			n.log.Warn("bad notification payload", "err", err)
+			continue
+		}
+		if p.Origin == n.origin {
+			continue
+		}
+		handle(ctx, chat.Event{Type: p.Type, ChatID: p.ChatID, MessageID: p.MessageID, UserID: p.UserID})
+	}
+}
@@ -11,17 +11,22 @@ import (
 	"gorm.io/gorm"
 )
 
+// DSN читаем DSN из окружения + дефолтное значение
+func DSN() string {
+	dsn := os.Getenv("DATABASE_DSN")
+	if dsn == "" {
+		dsn = "postgres://postgres:postgres@db:5432/chatdb?sslmode=disable"
+	}
+	return dsn
+}
+
 // возвращаем
 // *gorm.DB объект, с которым будем работать
 // *sql.DB для настройки пула, ping и Close() (закроем через defer в main.go)
 
 func OpenPostgres(ctx context.Context) (*gorm.DB, *sql.DB, error) {
 
-	// читаем DSN из окружения + дефолтное значение
-	dsn := os.Getenv("DATABASE_DSN")
-	if dsn == "" {
-		dsn = "postgres://postgres:postgres@db:5432/chatdb?sslmode=disable"
-	}
+	dsn := DSN()
 
 	// открываем GORM соединение
 	gdb, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
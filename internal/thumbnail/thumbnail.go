@@ -0,0 +1,93 @@
+package thumbnail
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/draw"
+)
+
+// DefaultMaxSide длинная сторона превью по умолчанию, в пикселях
+const DefaultMaxSide = 320
+
+// maxPixels больше этого картинку не декодируем: маленький файл может распаковаться в гигабайты пикселей
+const maxPixels = 40_000_000
+
+// headerPeek сколько байт начала файла отдаем DecodeConfig
+const headerPeek = 256 << 10
+
+// ErrUnsupported формат не PNG, JPEG или GIF, либо картинка слишком большая
+var ErrUnsupported = errors.New("unsupported image")
+
+// Maker делает уменьшенные копии картинок. JPEG остается JPEG, PNG и GIF превращаются в PNG, чтобы сохранить прозрачность.
+// У GIF берется первый кадр
+type Maker struct {
+	maxSide int
+}
+
+// New maxSide предельная длинная сторона превью, 0 значит DefaultMaxSide
+func New(maxSide int) *Maker {
+	if maxSide <= 0 {
+		maxSide = DefaultMaxSide
+	}
+	return &Maker{maxSide: maxSide}
+}
+
+// Thumbnail читаем картинку из r и возвращаем превью и его Content-Type. Картинку меньше предела только перекодируем
+func (m *Maker) Thumbnail(r io.Reader) ([]byte, string, error) {
+	// размер из заголовка проверяем до декодирования всей картинки. У JPEG перед размером бывает EXIF до 64 КБ
+	br := bufio.NewReaderSize(r, headerPeek)
+	head, _ := br.Peek(headerPeek)
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(head))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrUnsupported, err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > maxPixels {
+		return nil, "", fmt.Errorf("%w: %dx%d", ErrUnsupported, cfg.Width, cfg.Height)
+	}
+
+	var src image.Image
+	switch format {
+	case "png":
+		src, err = png.Decode(br)
+	case "jpeg":
+		src, err = jpeg.Decode(br)
+	case "gif":
+		src, err = gif.Decode(br)
+	default:
+		return nil, "", fmt.Errorf("%w: %s", ErrUnsupported, format)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("decode %s: %w", format, err)
+	}
+
+	w, h := fit(src.Bounds().Dx(), src.Bounds().Dy(), m.maxSide)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+		return buf.Bytes(), "image/jpeg", err
+	}
+	err = png.Encode(&buf, dst)
+	return buf.Bytes(), "image/png", err
+}
+
+// fit размер, вписанный в квадрат side с сохранением пропорций, не больше исходного и не меньше 1 пикселя
+func fit(w, h, side int) (int, int) {
+	if w <= side && h <= side {
+		return w, h
+	}
+	if w >= h {
+		return side, max(1, h*side/w)
+	}
+	return max(1, w*side/h), side
+}
@@ -0,0 +1,368 @@
+package unfurl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+
+	"hitalent/internal/chat"
+)
+
+// Значения Config по умолчанию
+const (
+	DefaultTimeout  = 5 * time.Second
+	DefaultMaxBytes = 512 << 10
+	DefaultCacheTTL = time.Hour
+)
+
+// maxRedirects сколько редиректов проходим, каждый адрес заново проверяется защитой от SSRF
+const maxRedirects = 3
+
+// cacheSize сколько URL держим в кеше, при переполнении вытесняем истекшие, потом любые
+const cacheSize = 1024
+
+var (
+	// ErrBlocked адрес ведет во внутреннюю сеть (loopback, частные диапазоны, link-local и т.п.)
+	ErrBlocked = errors.New("blocked address")
+	// ErrNoPreview страница не HTML или в ней нет ни заголовка, ни описания
+	ErrNoPreview = errors.New("no preview")
+)
+
+// Config настройки Unfurler, нулевые поля заменяются значениями по умолчанию
+type Config struct {
+	Timeout  time.Duration // на весь запрос вместе с редиректами
+	MaxBytes int64         // сколько байт страницы читаем, метаданные обычно в начале
+	CacheTTL time.Duration // сколько живет результат для URL, неудачи кешируются на TTL/10
+	// AllowPrivate отключает защиту от SSRF, только для тестов с httptest
+	AllowPrivate bool
+}
+
+// Unfurler достает OpenGraph и <title> со страниц по ссылкам из сообщений
+type Unfurler struct {
+	cfg    Config
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+	now   func() time.Time
+}
+
+type cacheEntry struct {
+	preview chat.LinkPreview
+	err     error
+	expires time.Time
+}
+
+func New(cfg Config) *Unfurler {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = DefaultMaxBytes
+	}
+	if cfg.CacheTTL <= 0 {
+		cfg.CacheTTL = DefaultCacheTTL
+	}
+
+	dialer := &net.Dialer{Timeout: cfg.Timeout}
+	if !cfg.AllowPrivate {
+		// проверяем адрес, к которому реально подключаемся, уже после резолва: так не обойти защиту через DNS
+		dialer.Control = func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || blockedIP(ip) {
+				return fmt.Errorf("%w: %s", ErrBlocked, host)
+			}
+			return nil
+		}
+	}
+	transport := &http.Transport{
+		// прокси из окружения не используем, иначе проверялся бы адрес прокси, а не сайта
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   cfg.Timeout,
+		ResponseHeaderTimeout: cfg.Timeout,
+		MaxIdleConns:          16,
+		IdleConnTimeout:       30 * time.Second,
+	}
+
+	return &Unfurler{
+		cfg: cfg,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   cfg.Timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) > maxRedirects {
+					return errors.New("too many redirects")
+				}
+				return checkURL(req.URL)
+			},
+		},
+		cache: make(map[string]cacheEntry),
+		now:   time.Now,
+	}
+}
+
+// Unfurl превью страницы по ссылке, из кеша, если URL уже запрашивали
+func (u *Unfurler) Unfurl(ctx context.Context, rawURL string) (*chat.LinkPreview, error) {
+	if e, ok := u.cached(rawURL); ok {
+		if e.err != nil {
+			return nil, e.err
+		}
+		return &e.preview, nil
+	}
+
+	p, err := u.fetch(ctx, rawURL)
+	// отмену вызывающего не кешируем, это не свойство страницы
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	u.store(rawURL, p, err)
+	if err != nil {
+		return nil, err
+	}
+	cp := *p
+	return &cp, nil
+}
+
+// cached неистекшая запись кеша, запись копируется, поэтому превью можно отдавать наружу
+func (u *Unfurler) cached(rawURL string) (cacheEntry, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	e, ok := u.cache[rawURL]
+	if !ok || !e.expires.After(u.now()) {
+		return cacheEntry{}, false
+	}
+	return e, true
+}
+
+// store запоминаем результат для URL
+func (u *Unfurler) store(rawURL string, p *chat.LinkPreview, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := u.now()
+	if len(u.cache) >= cacheSize {
+		for k, e := range u.cache {
+			if !e.expires.After(now) {
+				delete(u.cache, k)
+			}
+		}
+		for k := range u.cache {
+			if len(u.cache) < cacheSize {
+				break
+			}
+			delete(u.cache, k)
+		}
+	}
+
+	e := cacheEntry{err: err, expires: now.Add(u.cfg.CacheTTL)}
+	if err != nil {
+		e.expires = now.Add(u.cfg.CacheTTL / 10)
+	} else {
+		e.preview = *p
+	}
+	u.cache[rawURL] = e
+}
+
+// fetch качаем начало страницы и разбираем метаданные
+func (u *Unfurler) fetch(ctx context.Context, rawURL string) (*chat.LinkPreview, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse url: %w", err)
+	}
+	if err := checkURL(target); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	req.Header.Set("User-Agent", "hitalent-unfurl/1.0")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: status %d", ErrNoPreview, resp.StatusCode)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if mt, _, _ := mime.ParseMediaType(contentType); mt != "text/html" && mt != "application/xhtml+xml" {
+		return nil, fmt.Errorf("%w: content type %q", ErrNoPreview, contentType)
+	}
+
+	// кодировку берем из заголовка или <meta charset>, страницы бывают в windows-1251
+	body, err := charset.NewReader(io.LimitReader(resp.Body, u.cfg.MaxBytes), contentType)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoPreview, err)
+	}
+	p := parse(body, resp.Request.URL)
+	if p.Title == "" && p.Description == "" {
+		return nil, ErrNoPreview
+	}
+	p.URL = rawURL
+	return p, nil
+}
+
+// parse читаем <head>: og:* в приоритете, <title> и meta description как запасные
+func parse(r io.Reader, base *url.URL) *chat.LinkPreview {
+	var (
+		p       chat.LinkPreview
+		title   string
+		desc    string
+		inTitle bool
+	)
+	z := html.NewTokenizer(r)
+loop:
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			// конец документа или обрезанное тело
+			break loop
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			switch tok.Data {
+			case "title":
+				inTitle = title == ""
+			case "meta":
+				key, content := metaAttrs(tok)
+				switch key {
+				case "og:title":
+					p.Title = content
+				case "og:description":
+					p.Description = content
+				case "og:image", "og:image:url":
+					if p.ImageURL == "" {
+						p.ImageURL = resolve(base, content)
+					}
+				case "og:site_name":
+					p.SiteName = content
+				case "description":
+					desc = content
+				}
+			case "body":
+				break loop
+			}
+		case html.TextToken:
+			if inTitle {
+				title += string(z.Text())
+			}
+		case html.EndTagToken:
+			tok := z.Token()
+			if tok.Data == "title" {
+				inTitle = false
+			}
+			if tok.Data == "head" {
+				break loop
+			}
+		}
+	}
+
+	if p.Title == "" {
+		p.Title = title
+	}
+	if p.Description == "" {
+		p.Description = desc
+	}
+	p.Title = clip(p.Title, 300)
+	p.Description = clip(p.Description, 1000)
+	p.SiteName = clip(p.SiteName, 100)
+	return &p
+}
+
+// metaAttrs ключ (property или name) и content тега meta
+func metaAttrs(tok html.Token) (string, string) {
+	var key, content string
+	for _, a := range tok.Attr {
+		switch strings.ToLower(a.Key) {
+		case "property", "name":
+			if key == "" {
+				key = strings.ToLower(strings.TrimSpace(a.Val))
+			}
+		case "content":
+			content = a.Val
+		}
+	}
+	return key, content
+}
+
+// resolve относительную ссылку на картинку делаем абсолютной, не http(s) отбрасываем
+func resolve(base *url.URL, ref string) string {
+	u, err := base.Parse(strings.TrimSpace(ref))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.String()) > 2048 {
+		return ""
+	}
+	return u.String()
+}
+
+// clip схлопываем пробелы и обрезаем до n символов
+func clip(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-1]) + "…"
+}
+
+// checkURL только http и https без логина в адресе
+func checkURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: scheme %q", ErrBlocked, u.Scheme)
+	}
+	if u.Hostname() == "" || u.User != nil {
+		return fmt.Errorf("%w: invalid host", ErrBlocked)
+	}
+	return nil
+}
+
+// blockedRanges диапазоны, которых нет среди стандартных проверок net.IP
+var blockedRanges = func() []*net.IPNet {
+	var out []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",     // "этот" сеть
+		"100.64.0.0/10", // CGNAT
+		"192.0.0.0/24",  // служебные IETF
+		"198.18.0.0/15", // тестирование сетей
+		"240.0.0.0/4",   // зарезервировано
+		"64:ff9b::/96",  // NAT64, внутри может быть частный IPv4
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		out = append(out, n)
+	}
+	return out
+}()
+
+// blockedIP адрес внутренней сети, куда ходить по ссылкам пользователей нельзя
+func blockedIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, n := range blockedRanges {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
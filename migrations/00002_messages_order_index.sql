@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- полный порядок сообщений в чате задается парой (created_at, id):
+-- id разруливает сообщения с одинаковым created_at (вставки в одной транзакции или в одну микросекунду)
+CREATE INDEX IF NOT EXISTS idx_messages_chat_created_id
+    ON messages (chat_id, created_at DESC, id DESC);
+
+-- старый индекс без id полностью покрывается новым
+DROP INDEX IF EXISTS idx_messages_desc;
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+CREATE INDEX IF NOT EXISTS idx_messages_desc
+    ON messages (chat_id, created_at DESC);
+
+DROP INDEX IF EXISTS idx_messages_chat_created_id;
+
+-- +goose StatementEnd
@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- updated_at время последнего изменения чата, version растет на каждое изменение и служит ETag для If-Match
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ;
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+
+UPDATE chats SET updated_at = created_at WHERE updated_at IS NULL;
+
+ALTER TABLE chats ALTER COLUMN updated_at SET NOT NULL;
+ALTER TABLE chats ALTER COLUMN updated_at SET DEFAULT NOW();
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+ALTER TABLE chats DROP COLUMN IF EXISTS version;
+ALTER TABLE chats DROP COLUMN IF EXISTS updated_at;
+
+-- +goose StatementEnd
@@ -0,0 +1,30 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- edited_at время последней правки, deleted_at время удаления (сообщение остается в истории как надгробие)
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS edited_at  TIMESTAMPTZ;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+
+-- прошлые версии текста сообщений для модераторов
+CREATE TABLE IF NOT EXISTS message_edits (
+id          BIGSERIAL PRIMARY KEY,
+message_id  BIGINT        NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+text        VARCHAR(5000) NOT NULL,
+created_at  TIMESTAMPTZ   NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_edits_message
+    ON message_edits (message_id, id);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP INDEX IF EXISTS idx_message_edits_message;
+DROP TABLE IF EXISTS message_edits;
+
+ALTER TABLE messages DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE messages DROP COLUMN IF EXISTS edited_at;
+
+-- +goose StatementEnd
@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+
+CREATE TABLE IF NOT EXISTS users (
+id          BIGSERIAL PRIMARY KEY,
+name        VARCHAR(100) NOT NULL,
+created_at  TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
+
+-- автор сообщения, у старых сообщений автора нет, поэтому колонка nullable
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS author_id BIGINT REFERENCES users(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS idx_messages_author
+    ON messages (author_id);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP INDEX IF EXISTS idx_messages_author;
+ALTER TABLE messages DROP COLUMN IF EXISTS author_id;
+
+DROP TABLE IF EXISTS users;
+
+-- +goose StatementEnd
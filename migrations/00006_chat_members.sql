@@ -0,0 +1,40 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- участники чата и их роли, без записи здесь пользователь не видит чат
+CREATE TABLE IF NOT EXISTS chat_members (
+chat_id     BIGINT       NOT NULL REFERENCES chats(id) ON DELETE CASCADE,
+user_id     BIGINT       NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+role        VARCHAR(16)  NOT NULL CHECK (role IN ('owner', 'admin', 'member', 'read-only')),
+created_at  TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+PRIMARY KEY (chat_id, user_id)
+);
+
+-- чаты пользователя для GET /chats
+CREATE INDEX IF NOT EXISTS idx_chat_members_user
+    ON chat_members (user_id, chat_id);
+
+-- чатам, созданным до этой миграции, владельцем становится автор первого сообщения, остальные авторы участниками.
+-- Чаты без сообщений с автором остаются без участников, им владельца назначают запросом из README
+INSERT INTO chat_members (chat_id, user_id, role)
+SELECT DISTINCT ON (m.chat_id) m.chat_id, m.author_id, 'owner'
+FROM messages m
+WHERE m.author_id IS NOT NULL
+ORDER BY m.chat_id, m.created_at, m.id
+ON CONFLICT DO NOTHING;
+
+INSERT INTO chat_members (chat_id, user_id, role)
+SELECT DISTINCT m.chat_id, m.author_id, 'member'
+FROM messages m
+WHERE m.author_id IS NOT NULL
+ON CONFLICT DO NOTHING;
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP INDEX IF EXISTS idx_chat_members_user;
+DROP TABLE IF EXISTS chat_members;
+
+-- +goose StatementEnd
@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- поисковый вектор текста сообщения, конфигурация russian стеммит и русские, и латинские слова
+-- у удаленных сообщений text пустой, поэтому они в поиск не попадают
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS search TSVECTOR
+    GENERATED ALWAYS AS (to_tsvector('russian', text)) STORED;
+
+-- полнотекстовый поиск по сообщениям
+CREATE INDEX IF NOT EXISTS idx_messages_search
+    ON messages USING GIN (search);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP INDEX IF EXISTS idx_messages_search;
+ALTER TABLE messages DROP COLUMN IF EXISTS search;
+
+-- +goose StatementEnd
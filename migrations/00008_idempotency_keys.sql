@@ -0,0 +1,33 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- ответы на запросы с Idempotency-Key, status 0 пока запрос выполняется.
+-- lease_id выдается при каждом занятии ключа: завершить или освободить его может только тот, кто его занял.
+-- К users ключи не привязаны: валидный токен пользователя, которого нет (еще не создан или уже удален),
+-- иначе получал бы 500 на вставке ключа. Ключи и так истекают через сутки
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+user_id       BIGINT        NOT NULL,
+key           VARCHAR(255)  NOT NULL,
+lease_id      CHAR(32)      NOT NULL,
+request_hash  CHAR(64)      NOT NULL,
+status        INT           NOT NULL DEFAULT 0,
+content_type  VARCHAR(255)  NOT NULL DEFAULT '',
+body          BYTEA,
+created_at    TIMESTAMPTZ   NOT NULL DEFAULT NOW(),
+expires_at    TIMESTAMPTZ   NOT NULL,
+PRIMARY KEY (user_id, key)
+);
+
+-- очистка истекших ключей
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires
+    ON idempotency_keys (expires_at);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP INDEX IF EXISTS idx_idempotency_keys_expires;
+DROP TABLE IF EXISTS idempotency_keys;
+
+-- +goose StatementEnd
@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- UUID, который клиент выдает сообщению до отправки, чтобы сопоставить его со своей локальной копией
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS client_id UUID;
+
+-- один client_id на чат, повторная отправка возвращает уже созданное сообщение
+CREATE UNIQUE INDEX IF NOT EXISTS uniq_messages_chat_client
+    ON messages (chat_id, client_id)
+    WHERE client_id IS NOT NULL;
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP INDEX IF EXISTS uniq_messages_chat_client;
+ALTER TABLE messages DROP COLUMN IF EXISTS client_id;
+
+-- +goose StatementEnd
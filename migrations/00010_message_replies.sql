@@ -0,0 +1,39 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- ответ в треде ссылается на корневое сообщение того же чата
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS parent_id BIGINT;
+
+-- составной внешний ключ требует уникальности (chat_id, id), он же не дает сослаться на сообщение из другого чата.
+-- У ADD CONSTRAINT нет IF NOT EXISTS, поэтому проверяем pg_constraint сами
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'uniq_messages_chat_id') THEN
+        ALTER TABLE messages
+            ADD CONSTRAINT uniq_messages_chat_id UNIQUE (chat_id, id);
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'fk_messages_parent') THEN
+        ALTER TABLE messages
+            ADD CONSTRAINT fk_messages_parent FOREIGN KEY (chat_id, parent_id)
+            REFERENCES messages (chat_id, id) ON DELETE CASCADE;
+    END IF;
+END $$;
+
+-- ответы треда по порядку и подсчет reply_count
+CREATE INDEX IF NOT EXISTS idx_messages_parent_created_id
+    ON messages (parent_id, created_at, id)
+    WHERE parent_id IS NOT NULL;
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP INDEX IF EXISTS idx_messages_parent_created_id;
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS fk_messages_parent;
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS uniq_messages_chat_id;
+ALTER TABLE messages DROP COLUMN IF EXISTS parent_id;
+
+-- +goose StatementEnd
@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- реакции на сообщения, одна реакция каждого эмодзи от пользователя
+CREATE TABLE IF NOT EXISTS message_reactions (
+message_id  BIGINT       NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+user_id     BIGINT       NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+emoji       VARCHAR(64)  NOT NULL,
+created_at  TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+PRIMARY KEY (message_id, user_id, emoji)
+);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP TABLE IF EXISTS message_reactions;
+
+-- +goose StatementEnd
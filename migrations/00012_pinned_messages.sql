@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- закрепленные сообщения чата, кто и когда закрепил
+CREATE TABLE IF NOT EXISTS pinned_messages (
+chat_id     BIGINT       NOT NULL,
+message_id  BIGINT       NOT NULL,
+pinned_by   BIGINT       REFERENCES users(id) ON DELETE SET NULL,
+pinned_at   TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+PRIMARY KEY (chat_id, message_id),
+FOREIGN KEY (chat_id, message_id) REFERENCES messages (chat_id, id) ON DELETE CASCADE
+);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP TABLE IF EXISTS pinned_messages;
+
+-- +goose StatementEnd
@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- докуда участник прочитал чат. last_read_at это created_at прочитанного сообщения,
+-- чтобы считать непрочитанные по индексу (chat_id, created_at, id) без join с messages.
+-- Пока строки нет, прочитанным считается все до вступления в чат
+CREATE TABLE IF NOT EXISTS chat_reads (
+chat_id               BIGINT       NOT NULL,
+user_id               BIGINT       NOT NULL,
+last_read_message_id  BIGINT       NOT NULL,
+last_read_at          TIMESTAMPTZ  NOT NULL,
+updated_at            TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+PRIMARY KEY (chat_id, user_id),
+FOREIGN KEY (chat_id, user_id) REFERENCES chat_members (chat_id, user_id) ON DELETE CASCADE
+);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP TABLE IF EXISTS chat_reads;
+
+-- +goose StatementEnd
@@ -0,0 +1,34 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- вложения сообщений, само содержимое лежит в blob-хранилище под storage_key.
+-- message_id пустой, пока вложение загружено, но еще не отправлено с сообщением
+CREATE TABLE IF NOT EXISTS attachments (
+id           BIGSERIAL    PRIMARY KEY,
+chat_id      BIGINT       NOT NULL REFERENCES chats(id) ON DELETE CASCADE,
+message_id   BIGINT,
+uploader_id  BIGINT       NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+filename     VARCHAR(255) NOT NULL,
+content_type VARCHAR(255) NOT NULL,
+size         BIGINT       NOT NULL CHECK (size > 0),
+storage_key  TEXT         NOT NULL UNIQUE,
+created_at   TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+FOREIGN KEY (chat_id, message_id) REFERENCES messages (chat_id, id) ON DELETE CASCADE
+);
+
+-- вложения страницы сообщений
+CREATE INDEX IF NOT EXISTS idx_attachments_message
+    ON attachments (message_id) WHERE message_id IS NOT NULL;
+
+-- очистка брошенных загрузок
+CREATE INDEX IF NOT EXISTS idx_attachments_pending
+    ON attachments (created_at) WHERE message_id IS NULL;
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP TABLE IF EXISTS attachments;
+
+-- +goose StatementEnd
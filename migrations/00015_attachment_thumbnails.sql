@@ -0,0 +1,27 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- превью картинок: состояние обработки и где лежит готовое превью.
+-- Пустое состояние у вложений, для которых превью не делается
+ALTER TABLE attachments
+    ADD COLUMN IF NOT EXISTS thumbnail_state        VARCHAR(16) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS thumbnail_key          TEXT        NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS thumbnail_content_type VARCHAR(255) NOT NULL DEFAULT '';
+
+-- воркеры подбирают вложения, застрявшие в обработке
+CREATE INDEX IF NOT EXISTS idx_attachments_thumbnail_processing
+    ON attachments (created_at) WHERE thumbnail_state = 'processing';
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP INDEX IF EXISTS idx_attachments_thumbnail_processing;
+
+ALTER TABLE attachments
+    DROP COLUMN IF EXISTS thumbnail_content_type,
+    DROP COLUMN IF EXISTS thumbnail_key,
+    DROP COLUMN IF EXISTS thumbnail_state;
+
+-- +goose StatementEnd
@@ -0,0 +1,34 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- превью ссылок из текста сообщений, заполняются асинхронно после отправки
+CREATE TABLE IF NOT EXISTS link_previews (
+message_id   BIGINT       NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+url          TEXT         NOT NULL,
+position     SMALLINT     NOT NULL,
+title        TEXT         NOT NULL DEFAULT '',
+description  TEXT         NOT NULL DEFAULT '',
+image_url    TEXT         NOT NULL DEFAULT '',
+site_name    TEXT         NOT NULL DEFAULT '',
+created_at   TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+PRIMARY KEY (message_id, url)
+);
+
+-- сообщения, превью ссылок которых не влезли в очередь воркеров, их подбирает пересканирование
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS unfurl_pending BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE INDEX IF NOT EXISTS idx_messages_unfurl_pending
+    ON messages (id) WHERE unfurl_pending AND deleted_at IS NULL;
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP INDEX IF EXISTS idx_messages_unfurl_pending;
+
+ALTER TABLE messages DROP COLUMN IF EXISTS unfurl_pending;
+
+DROP TABLE IF EXISTS link_previews;
+
+-- +goose StatementEnd
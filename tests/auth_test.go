@@ -0,0 +1,72 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+
+	"hitalent/internal/chat"
+	"hitalent/internal/httpapi"
+)
+
+// Проверка AuthMiddleware без БД: какие токены проходят и что попадает в контекст
+func TestAuthMiddleware(t *testing.T) {
+
+	verifier, err := httpapi.NewTokenVerifier(testSecret, nil)
+	require.NoError(t, err)
+
+	// обработчик отдает id пользователя из контекста
+	handler := httpapi.AuthMiddleware(verifier, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := chat.UserIDFromContext(r.Context())
+		require.True(t, ok)
+		_, _ = w.Write([]byte(strconv.FormatInt(id, 10)))
+	}))
+
+	sign := func(method jwt.SigningMethod, key any, claims jwt.RegisteredClaims) string {
+		token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		require.NoError(t, err)
+		return token
+	}
+	call := func(authHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/chats", nil)
+		if authHeader != "" {
+			req.Header.Set("Authorization", authHeader)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	valid := jwt.RegisteredClaims{Subject: "42", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+
+	// валидный токен
+	rec := call("Bearer " + sign(jwt.SigningMethodHS256, testSecret, valid))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "42", rec.Body.String())
+
+	// без заголовка, чужой секрет, истекший токен, без exp, кривой sub
+	expired := valid
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+	noExp := valid
+	noExp.ExpiresAt = nil
+	badSub := valid
+	badSub.Subject = "alice"
+
+	for name, header := range map[string]string{
+		"missing":      "",
+		"not bearer":   "Basic abc",
+		"wrong secret": "Bearer " + sign(jwt.SigningMethodHS256, []byte("other"), valid),
+		"expired":      "Bearer " + sign(jwt.SigningMethodHS256, testSecret, expired),
+		"no exp":       "Bearer " + sign(jwt.SigningMethodHS256, testSecret, noExp),
+		"bad sub":      "Bearer " + sign(jwt.SigningMethodHS256, testSecret, badSub),
+		"wrong alg":    "Bearer " + sign(jwt.SigningMethodHS512, testSecret, valid),
+	} {
+		rec := call(header)
+		require.Equal(t, http.StatusUnauthorized, rec.Code, name)
+		require.JSONEq(t, `{"error":"unauthorized"}`, rec.Body.String(), name)
+	}
+}
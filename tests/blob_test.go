@@ -0,0 +1,125 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"hitalent/internal/blob"
+	"hitalent/internal/chat"
+)
+
+// Локальное хранилище без БД: запись, чтение, удаление и ключи вне каталога
+func TestBlobFS_PutGetDelete(t *testing.T) {
+
+	ctx := context.Background()
+	store, err := blob.NewFS(t.TempDir())
+	require.NoError(t, err)
+
+	data := []byte("hello attachment")
+	require.NoError(t, store.Put(ctx, "chats/1/abc", bytes.NewReader(data), int64(len(data)), "text/plain"))
+
+	rc, err := store.Get(ctx, "chats/1/abc")
+	require.NoError(t, err)
+	got, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, data, got)
+
+	// размер не совпал с заявленным, файл не появляется
+	require.Error(t, store.Put(ctx, "chats/1/short", strings.NewReader("abc"), 10, ""))
+	_, err = store.Get(ctx, "chats/1/short")
+	require.ErrorIs(t, err, chat.ErrNotFound)
+
+	require.NoError(t, store.Delete(ctx, "chats/1/abc"))
+	require.NoError(t, store.Delete(ctx, "chats/1/abc"))
+	_, err = store.Get(ctx, "chats/1/abc")
+	require.ErrorIs(t, err, chat.ErrNotFound)
+
+	for _, key := range []string{"../escape", "/etc/passwd", "", "a/../../b"} {
+		require.Error(t, store.Put(ctx, key, strings.NewReader("x"), 1, ""), key)
+	}
+}
+
+// fakeS3 минимальная замена MinIO: объекты в памяти по пути /bucket/key, запрос без подписи V4 отклоняем
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	types   map[string]string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=test-key/") ||
+		!strings.Contains(auth, "SignedHeaders=host;x-amz-content-sha256;x-amz-date") ||
+		r.Header.Get("X-Amz-Date") == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		if r.ContentLength < 0 {
+			w.WriteHeader(http.StatusLengthRequired)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		f.objects[r.URL.Path] = data
+		f.types[r.URL.Path] = r.Header.Get("Content-Type")
+	case http.MethodGet:
+		data, ok := f.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = io.WriteString(w, "<Error><Code>NoSuchKey</Code></Error>")
+			return
+		}
+		_, _ = w.Write(data)
+	case http.MethodDelete:
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// S3-совместимое хранилище против заглушки на httptest
+func TestBlobS3_AgainstStandIn(t *testing.T) {
+
+	fake := &fakeS3{objects: map[string][]byte{}, types: map[string]string{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	ctx := context.Background()
+	store, err := blob.NewS3(blob.S3Config{Endpoint: srv.URL, Bucket: "files", AccessKey: "test-key", SecretKey: "secret"})
+	require.NoError(t, err)
+
+	data := bytes.Repeat([]byte("z"), 3<<20)
+	require.NoError(t, store.Put(ctx, "chats/7/obj", bytes.NewReader(data), int64(len(data)), "image/png"))
+	require.Len(t, fake.objects["/files/chats/7/obj"], len(data))
+	require.Equal(t, "image/png", fake.types["/files/chats/7/obj"])
+
+	rc, err := store.Get(ctx, "chats/7/obj")
+	require.NoError(t, err)
+	got, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, data, got)
+
+	require.NoError(t, store.Delete(ctx, "chats/7/obj"))
+	_, err = store.Get(ctx, "chats/7/obj")
+	require.ErrorIs(t, err, chat.ErrNotFound)
+
+	// неверные ключи доступа отклоняются, ошибка не ErrNotFound
+	bad, err := blob.NewS3(blob.S3Config{Endpoint: srv.URL, Bucket: "files", AccessKey: "other", SecretKey: "secret"})
+	require.NoError(t, err)
+	err = bad.Put(ctx, "chats/7/obj", strings.NewReader("x"), 1, "")
+	require.Error(t, err)
+	require.NotErrorIs(t, err, chat.ErrNotFound)
+}
@@ -6,19 +6,32 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"image"
+	"image/jpeg"
 	"io"
+	"io/fs"
 	"log/slog"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/require"
 
+	"hitalent/internal/blob"
 	"hitalent/internal/chat"
 	"hitalent/internal/httpapi"
+	"hitalent/internal/realtime"
 	"hitalent/internal/storage"
+	"hitalent/internal/thumbnail"
+	"hitalent/internal/unfurl"
 )
 
 func TestChatAPI_Path_And_CascadeDelete(t *testing.T) {
@@ -104,7 +117,1436 @@ func TestChatAPI_CreateMessage_NotFound(t *testing.T) {
 	require.Equal(t, http.StatusNotFound, status)
 }
 
+// Проверка пагинации по курсорам: листаем историю назад через prev_cursor и вперед через next_cursor
+func TestChatAPI_GetChat_CursorPagination(t *testing.T) {
+
+	srv, _ := startTestServer(t)
+	defer srv.Close()
+
+	chatID := createChat(t, srv.URL, "paging")
+	for i := 1; i <= 5; i++ {
+		status, _ := doJSON(t, http.MethodPost, fmt.Sprintf("%s/chats/%d/messages/", srv.URL, chatID), map[string]any{
+			"text": fmt.Sprintf("msg %d", i),
+		})
+		require.Equal(t, http.StatusCreated, status)
+	}
+
+	type page struct {
+		Messages []struct {
+			Text string `json:"text"`
+		} `json:"messages"`
+		NextCursor string `json:"next_cursor"`
+		PrevCursor string `json:"prev_cursor"`
+	}
+	get := func(query string) page {
+		var p page
+		status, body := doRaw(t, http.MethodGet, fmt.Sprintf("%s/chats/%d?%s", srv.URL, chatID, query), nil)
+		require.Equal(t, http.StatusOK, status)
+		require.NoError(t, json.Unmarshal(body, &p))
+		return p
+	}
+	texts := func(p page) []string {
+		out := make([]string, 0, len(p.Messages))
+		for _, m := range p.Messages {
+			out = append(out, m.Text)
+		}
+		return out
+	}
+
+	// последние 2 сообщения, новее ничего нет
+	last := get("limit=2")
+	require.Equal(t, []string{"msg 4", "msg 5"}, texts(last))
+	require.NotEmpty(t, last.PrevCursor)
+	require.Empty(t, last.NextCursor)
+
+	// листаем назад
+	older := get("limit=2&before=" + last.PrevCursor)
+	require.Equal(t, []string{"msg 2", "msg 3"}, texts(older))
+	require.NotEmpty(t, older.NextCursor)
+
+	oldest := get("limit=2&before=" + older.PrevCursor)
+	require.Equal(t, []string{"msg 1"}, texts(oldest))
+	require.Empty(t, oldest.PrevCursor)
+
+	// и обратно вперед
+	newer := get("limit=2&after=" + oldest.NextCursor)
+	require.Equal(t, []string{"msg 2", "msg 3"}, texts(newer))
+
+	// некорректный курсор и оба курсора сразу это 400
+	status, _ := doRaw(t, http.MethodGet, fmt.Sprintf("%s/chats/%d?before=garbage", srv.URL, chatID), nil)
+	require.Equal(t, http.StatusBadRequest, status)
+	status, _ = doRaw(t, http.MethodGet, fmt.Sprintf("%s/chats/%d?before=%s&after=%s", srv.URL, chatID, last.PrevCursor, last.PrevCursor), nil)
+	require.Equal(t, http.StatusBadRequest, status)
+}
+
+// Сообщения с одинаковым created_at всегда возвращаются в порядке id
+func TestChatAPI_GetChat_StableOrderOnEqualTimestamps(t *testing.T) {
+
+	srv, db := startTestServer(t)
+	defer srv.Close()
+
+	chatID := createChat(t, srv.URL, "same time")
+
+	// вставляем пачку сообщений одним запросом: у всех created_at = NOW() транзакции
+	_, err := db.ExecContext(context.Background(),
+		`INSERT INTO messages (chat_id, text) SELECT $1, 'msg ' || g FROM generate_series(1, 30) AS g`, chatID)
+	require.NoError(t, err)
+
+	var resp struct {
+		Messages []struct {
+			ID int64 `json:"id"`
+		} `json:"messages"`
+		PrevCursor string `json:"prev_cursor"`
+	}
+
+	// листаем историю назад, все страницы вместе дают сообщения строго по возрастанию id
+	var ids []int64
+	query := "limit=10"
+	for {
+		status, body := doRaw(t, http.MethodGet, fmt.Sprintf("%s/chats/%d?%s", srv.URL, chatID, query), nil)
+		require.Equal(t, http.StatusOK, status)
+		resp.PrevCursor = ""
+		require.NoError(t, json.Unmarshal(body, &resp))
+		page := make([]int64, 0, len(resp.Messages))
+		for _, m := range resp.Messages {
+			page = append(page, m.ID)
+		}
+		ids = append(page, ids...)
+		if resp.PrevCursor == "" {
+			break
+		}
+		query = "limit=10&before=" + resp.PrevCursor
+	}
+
+	require.Len(t, ids, 30)
+	for i := 1; i < len(ids); i++ {
+		require.Less(t, ids[i-1], ids[i])
+	}
+}
+
+// Проверка GET /chats/{id}/messages: порядок, диапазон дат и 404 для несуществующего чата
+func TestChatAPI_ListMessages(t *testing.T) {
+
+	srv, db := startTestServer(t)
+	defer srv.Close()
+
+	chatID := createChat(t, srv.URL, "list")
+
+	// сообщения с известным временем, по одному в час
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		_, err := db.ExecContext(context.Background(),
+			`INSERT INTO messages (chat_id, text, created_at) VALUES ($1, $2, $3)`,
+			chatID, fmt.Sprintf("msg %d", i), base.Add(time.Duration(i)*time.Hour))
+		require.NoError(t, err)
+	}
+
+	list := func(query string) []string {
+		var resp struct {
+			Messages []struct {
+				Text string `json:"text"`
+			} `json:"messages"`
+		}
+		status, body := doRaw(t, http.MethodGet, fmt.Sprintf("%s/chats/%d/messages?%s", srv.URL, chatID, query), nil)
+		require.Equal(t, http.StatusOK, status)
+		require.NoError(t, json.Unmarshal(body, &resp))
+		out := make([]string, 0, len(resp.Messages))
+		for _, m := range resp.Messages {
+			out = append(out, m.Text)
+		}
+		return out
+	}
+
+	require.Equal(t, []string{"msg 0", "msg 1"}, list("limit=2"))
+	require.Equal(t, []string{"msg 3", "msg 2"}, list("limit=2&order=desc"))
+	require.Equal(t, []string{"msg 1", "msg 2"}, list("since="+base.Add(time.Hour).Format(time.RFC3339)+
+		"&until="+base.Add(3*time.Hour).Format(time.RFC3339)))
+
+	status, _ := doRaw(t, http.MethodGet, srv.URL+"/chats/999999/messages", nil)
+	require.Equal(t, http.StatusNotFound, status)
+	status, _ = doRaw(t, http.MethodGet, fmt.Sprintf("%s/chats/%d/messages?order=sideways", srv.URL, chatID), nil)
+	require.Equal(t, http.StatusBadRequest, status)
+}
+
+// Проверка GET /chats: фильтр по заголовку, сортировка по активности, сводка и курсор
+func TestChatAPI_ListChats(t *testing.T) {
+
+	srv, _ := startTestServer(t)
+	defer srv.Close()
+
+	general := createChat(t, srv.URL, "General")
+	random := createChat(t, srv.URL, "Random talk")
+	createChat(t, srv.URL, "general-2")
+
+	// в самый старый чат пишем сообщение, он становится самым активным
+	status, _ := doJSON(t, http.MethodPost, fmt.Sprintf("%s/chats/%d/messages/", srv.URL, general), map[string]any{"text": "hi"})
+	require.Equal(t, http.StatusCreated, status)
+
+	// удаленное сообщение не считается и не двигает активность
+	deleted := createMessage(t, srv.URL, random, "oops")
+	status, _ = doRaw(t, http.MethodDelete, fmt.Sprintf("%s/chats/%d/messages/%d", srv.URL, random, deleted), nil)
+	require.Equal(t, http.StatusNoContent, status)
+
+	type listResp struct {
+		Chats []struct {
+			ID            int64      `json:"id"`
+			Title         string     `json:"title"`
+			MessageCount  int64      `json:"message_count"`
+			LastMessageAt *time.Time `json:"last_message_at"`
+		} `json:"chats"`
+		NextCursor string `json:"next_cursor"`
+	}
+	list := func(query string) listResp {
+		var resp listResp
+		status, body := doRaw(t, http.MethodGet, srv.URL+"/chats?"+query, nil)
+		require.Equal(t, http.StatusOK, status)
+		require.NoError(t, json.Unmarshal(body, &resp))
+		return resp
+	}
+
+	// фильтр без учета регистра
+	found := list("title=GENERAL")
+	require.Len(t, found.Chats, 2)
+
+	// по активности первым идет чат с сообщением
+	active := list("sort=activity&limit=1")
+	require.Len(t, active.Chats, 1)
+	require.Equal(t, general, active.Chats[0].ID)
+	require.Equal(t, int64(1), active.Chats[0].MessageCount)
+	require.NotNil(t, active.Chats[0].LastMessageAt)
+	require.NotEmpty(t, active.NextCursor)
+
+	// по created_at листаем курсором до конца
+	first := list("limit=2")
+	require.Len(t, first.Chats, 2)
+	rest := list("limit=2&cursor=" + first.NextCursor)
+	require.Len(t, rest.Chats, 1)
+	require.Equal(t, general, rest.Chats[0].ID)
+	require.Empty(t, rest.NextCursor)
+	require.Equal(t, random, first.Chats[1].ID)
+	require.Zero(t, first.Chats[1].MessageCount)
+	require.Nil(t, first.Chats[1].LastMessageAt)
+
+	// курсор истории сообщений не подходит списку чатов и наоборот
+	createMessage(t, srv.URL, general, "again")
+	var history struct {
+		PrevCursor string `json:"prev_cursor"`
+	}
+	status, body := doRaw(t, http.MethodGet, fmt.Sprintf("%s/chats/%d?limit=1", srv.URL, general), nil)
+	require.Equal(t, http.StatusOK, status)
+	require.NoError(t, json.Unmarshal(body, &history))
+	require.NotEmpty(t, history.PrevCursor)
+	status, _ = doRaw(t, http.MethodGet, srv.URL+"/chats?cursor="+history.PrevCursor, nil)
+	require.Equal(t, http.StatusBadRequest, status)
+	status, _ = doRaw(t, http.MethodGet, fmt.Sprintf("%s/chats/%d?before=%s", srv.URL, general, first.NextCursor), nil)
+	require.Equal(t, http.StatusBadRequest, status)
+}
+
+// Проверка PATCH /chats/{id}: переименование и защита от параллельной перезаписи через If-Match
+func TestChatAPI_UpdateChat_IfMatch(t *testing.T) {
+
+	srv, _ := startTestServer(t)
+	defer srv.Close()
+
+	chatID := createChat(t, srv.URL, "old title")
+	url := fmt.Sprintf("%s/chats/%d", srv.URL, chatID)
+
+	// ETag берем из GET
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	require.NotEmpty(t, etag)
+
+	patch := func(ifMatch, title string) (int, string) {
+		b, err := json.Marshal(map[string]any{"title": title})
+		require.NoError(t, err)
+		req, err := http.NewRequest(http.MethodPatch, url, bytes.NewReader(b))
+		require.NoError(t, err)
+		req.Header.Set("If-Match", ifMatch)
+		req.Header.Set("Authorization", "Bearer "+testToken)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode, resp.Header.Get("ETag")
+	}
+
+	// первое переименование проходит и меняет ETag
+	status, newETag := patch(etag, "  new title ")
+	require.Equal(t, http.StatusOK, status)
+	require.NotEqual(t, etag, newETag)
+
+	// второе со старым ETag получает 412
+	status, _ = patch(etag, "other title")
+	require.Equal(t, http.StatusPreconditionFailed, status)
+
+	var got struct {
+		Chat struct {
+			Title string `json:"title"`
+		} `json:"chat"`
+	}
+	status, body := doRaw(t, http.MethodGet, url, nil)
+	require.Equal(t, http.StatusOK, status)
+	require.NoError(t, json.Unmarshal(body, &got))
+	require.Equal(t, "new title", got.Chat.Title)
+
+	// валидация как при создании
+	status, _ = patch(newETag, "   ")
+	require.Equal(t, http.StatusBadRequest, status)
+}
+
+// Проверка правки и удаления сообщения: история правок и надгробие в GET /chats/{id}
+func TestChatAPI_EditAndDeleteMessage(t *testing.T) {
+
+	srv, _ := startTestServer(t)
+	defer srv.Close()
+
+	chatID := createChat(t, srv.URL, "edits")
+	msgID := createMessage(t, srv.URL, chatID, "first")
+	msgURL := fmt.Sprintf("%s/chats/%d/messages/%d", srv.URL, chatID, msgID)
+
+	status, _ := doJSON(t, http.MethodPatch, msgURL, map[string]any{"text": "second"})
+	require.Equal(t, http.StatusOK, status)
+
+	status, _ = doRaw(t, http.MethodDelete, msgURL, nil)
+	require.Equal(t, http.StatusNoContent, status)
+
+	// удаленное сообщение больше не редактируется
+	status, _ = doJSON(t, http.MethodPatch, msgURL, map[string]any{"text": "third"})
+	require.Equal(t, http.StatusNotFound, status)
+
+	var history struct {
+		Message struct {
+			Text      string     `json:"text"`
+			EditedAt  *time.Time `json:"edited_at"`
+			DeletedAt *time.Time `json:"deleted_at"`
+		} `json:"message"`
+		Edits []struct {
+			Text string `json:"text"`
+		} `json:"edits"`
+	}
+	status, body := doRaw(t, http.MethodGet, msgURL+"/history", nil)
+	require.Equal(t, http.StatusOK, status)
+	require.NoError(t, json.Unmarshal(body, &history))
+	require.Empty(t, history.Message.Text)
+	require.NotNil(t, history.Message.EditedAt)
+	require.NotNil(t, history.Message.DeletedAt)
+	require.Len(t, history.Edits, 2)
+	require.Equal(t, "first", history.Edits[0].Text)
+	require.Equal(t, "second", history.Edits[1].Text)
+
+	// в чате сообщение осталось надгробием
+	var got struct {
+		Messages []struct {
+			ID        int64      `json:"id"`
+			Text      string     `json:"text"`
+			DeletedAt *time.Time `json:"deleted_at"`
+		} `json:"messages"`
+	}
+	status, body = doRaw(t, http.MethodGet, fmt.Sprintf("%s/chats/%d", srv.URL, chatID), nil)
+	require.Equal(t, http.StatusOK, status)
+	require.NoError(t, json.Unmarshal(body, &got))
+	require.Len(t, got.Messages, 1)
+	require.Equal(t, msgID, got.Messages[0].ID)
+	require.Empty(t, got.Messages[0].Text)
+	require.NotNil(t, got.Messages[0].DeletedAt)
+}
+
+// Проверка пользователей и авторства: автор берется из токена, его имя приходит вместе с сообщениями чата
+func TestChatAPI_MessageAuthor(t *testing.T) {
+
+	srv, _ := startTestServer(t)
+	defer srv.Close()
+
+	var user struct {
+		ID   int64  `json:"id"`
+		Name string `json:"name"`
+	}
+	status, body := doJSON(t, http.MethodPost, srv.URL+"/users", map[string]any{"name": " Alice "})
+	require.Equal(t, http.StatusCreated, status)
+	require.NoError(t, json.Unmarshal(body, &user))
+	require.Equal(t, "Alice", user.Name)
+
+	status, _ = doRaw(t, http.MethodGet, fmt.Sprintf("%s/users/%d", srv.URL, user.ID), nil)
+	require.Equal(t, http.StatusOK, status)
+
+	// писать в чат может только участник, поэтому сначала добавляем Alice
+	chatID := createChat(t, srv.URL, "authors")
+	status, _ = doJSON(t, http.MethodPost, fmt.Sprintf("%s/chats/%d/members", srv.URL, chatID), map[string]any{"user_id": user.ID})
+	require.Equal(t, http.StatusCreated, status)
+
+	status, _ = doJSONAs(t, tokenFor(t, user.ID), http.MethodPost, fmt.Sprintf("%s/chats/%d/messages/", srv.URL, chatID), map[string]any{
+		"text": "hello",
+	})
+	require.Equal(t, http.StatusCreated, status)
+
+	// токен несуществующего пользователя и запрос без токена это 401
+	status, _ = doJSONAs(t, tokenFor(t, user.ID+1000), http.MethodPost, fmt.Sprintf("%s/chats/%d/messages/", srv.URL, chatID), map[string]any{
+		"text": "hello",
+	})
+	require.Equal(t, http.StatusUnauthorized, status)
+	status, _ = doRawAs(t, "", http.MethodGet, fmt.Sprintf("%s/chats/%d", srv.URL, chatID), nil)
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	var got struct {
+		Messages []struct {
+			AuthorID int64 `json:"author_id"`
+			Author   *struct {
+				ID   int64  `json:"id"`
+				Name string `json:"name"`
+			} `json:"author"`
+		} `json:"messages"`
+	}
+	status, body = doRaw(t, http.MethodGet, fmt.Sprintf("%s/chats/%d", srv.URL, chatID), nil)
+	require.Equal(t, http.StatusOK, status)
+	require.NoError(t, json.Unmarshal(body, &got))
+	require.Len(t, got.Messages, 1)
+	require.Equal(t, user.ID, got.Messages[0].AuthorID)
+	require.NotNil(t, got.Messages[0].Author)
+	require.Equal(t, "Alice", got.Messages[0].Author.Name)
+}
+
+// Проверка участников и ролей: чужой чат 403, read-only только читает, последний владелец не уходит
+func TestChatAPI_Membership(t *testing.T) {
+
+	srv, db := startTestServer(t)
+	defer srv.Close()
+
+	chatID := createChat(t, srv.URL, "private")
+	chatURL := fmt.Sprintf("%s/chats/%d", srv.URL, chatID)
+	bobID := createUser(t, db, "Bob")
+	bob := tokenFor(t, bobID)
+
+	// Bob не участник
+	status, _ := doRawAs(t, bob, http.MethodGet, chatURL, nil)
+	require.Equal(t, http.StatusForbidden, status)
+
+	// добавляем Bob только на чтение
+	status, _ = doJSON(t, http.MethodPost, chatURL+"/members", map[string]any{"user_id": bobID, "role": "read-only"})
+	require.Equal(t, http.StatusCreated, status)
+
+	status, _ = doRawAs(t, bob, http.MethodGet, chatURL, nil)
+	require.Equal(t, http.StatusOK, status)
+	status, _ = doJSONAs(t, bob, http.MethodPost, chatURL+"/messages", map[string]any{"text": "hi"})
+	require.Equal(t, http.StatusForbidden, status)
+
+	// повышаем до member, теперь пишет, но не удаляет чат и не управляет участниками
+	status, _ = doJSON(t, http.MethodPost, chatURL+"/members", map[string]any{"user_id": bobID, "role": "member"})
+	require.Equal(t, http.StatusOK, status)
+	status, _ = doJSONAs(t, bob, http.MethodPost, chatURL+"/messages", map[string]any{"text": "hi"})
+	require.Equal(t, http.StatusCreated, status)
+	status, _ = doRawAs(t, bob, http.MethodDelete, chatURL, nil)
+	require.Equal(t, http.StatusForbidden, status)
+	status, _ = doJSONAs(t, bob, http.MethodPost, chatURL+"/members", map[string]any{"user_id": bobID, "role": "admin"})
+	require.Equal(t, http.StatusForbidden, status)
+
+	var members struct {
+		Members []struct {
+			UserID int64  `json:"user_id"`
+			Role   string `json:"role"`
+		} `json:"members"`
+	}
+	status, body := doRawAs(t, bob, http.MethodGet, chatURL+"/members", nil)
+	require.Equal(t, http.StatusOK, status)
+	require.NoError(t, json.Unmarshal(body, &members))
+	require.Len(t, members.Members, 2)
+	require.Equal(t, "owner", members.Members[0].Role)
+
+	// единственный владелец не может уйти, Bob может
+	status, _ = doRaw(t, http.MethodDelete, fmt.Sprintf("%s/members/%d", chatURL, members.Members[0].UserID), nil)
+	require.Equal(t, http.StatusConflict, status)
+	status, _ = doRawAs(t, bob, http.MethodDelete, fmt.Sprintf("%s/members/%d", chatURL, bobID), nil)
+	require.Equal(t, http.StatusNoContent, status)
+	status, _ = doRawAs(t, bob, http.MethodGet, chatURL, nil)
+	require.Equal(t, http.StatusForbidden, status)
+}
+
+// Первого пользователя создают токеном, за которым пользователя еще нет, дальше неизвестный токен получает 401
+func TestChatAPI_BootstrapUser(t *testing.T) {
+
+	srv, db := startTestServer(t)
+	defer srv.Close()
+
+	// тестовый сервер уже создал своего пользователя, начинаем с пустой базы
+	cleanDB(t, db)
+
+	status, body := doJSONAs(t, tokenFor(t, 999999), http.MethodPost, srv.URL+"/users", map[string]any{"name": "admin"})
+	require.Equal(t, http.StatusCreated, status)
+	var u struct {
+		ID int64 `json:"id"`
+	}
+	require.NoError(t, json.Unmarshal(body, &u))
+
+	status, _ = doRawAs(t, tokenFor(t, u.ID), http.MethodGet, srv.URL+"/chats", nil)
+	require.Equal(t, http.StatusOK, status)
+
+	// ключ идемпотентности не привязан к users: токен без пользователя получает 401, а не ошибку вставки ключа
+	b, err := json.Marshal(map[string]any{"title": "ghost"})
+	require.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/chats", bytes.NewReader(b))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+tokenFor(t, 999999))
+	req.Header.Set("Idempotency-Key", "ghost")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// пользователь уже есть: токен без пользователя больше никого не создает, а существующий создает
+	status, _ = doJSONAs(t, tokenFor(t, 999998), http.MethodPost, srv.URL+"/users", map[string]any{"name": "intruder"})
+	require.Equal(t, http.StatusUnauthorized, status)
+	status, _ = doJSONAs(t, tokenFor(t, u.ID), http.MethodPost, srv.URL+"/users", map[string]any{"name": "colleague"})
+	require.Equal(t, http.StatusCreated, status)
+}
+
+func TestChatAPI_GetChatLongPoll(t *testing.T) {
+
+	srv, _ := startTestServer(t)
+	defer srv.Close()
+
+	chatID := createChat(t, srv.URL, "poll")
+	first := createMessage(t, srv.URL, chatID, "one")
+
+	status, _ := doJSON(t, http.MethodPut, fmt.Sprintf("%s/chats/%d/messages/%d/reactions/%s", srv.URL, chatID, first, url.PathEscape("👍")), nil)
+	require.Equal(t, http.StatusCreated, status)
+	status, _ = doJSON(t, http.MethodPut, fmt.Sprintf("%s/chats/%d/messages/%d/pin", srv.URL, chatID, first), nil)
+	require.Equal(t, http.StatusCreated, status)
+
+	type pollResp struct {
+		Messages []chat.Message `json:"messages"`
+		Pinned   []chat.Pin     `json:"pinned"`
+		Unread   *int64         `json:"unread_count"`
+	}
+
+	// есть сообщения новее after_id: отвечаем сразу, сообщения в том же виде, что и без after_id
+	status, body := doJSON(t, http.MethodGet, fmt.Sprintf("%s/chats/%d?after_id=0&wait=5s", srv.URL, chatID), nil)
+	require.Equal(t, http.StatusOK, status)
+	var got pollResp
+	require.NoError(t, json.Unmarshal(body, &got))
+	require.Len(t, got.Messages, 1)
+	require.Equal(t, first, got.Messages[0].ID)
+	require.NotNil(t, got.Messages[0].Author)
+	require.Equal(t, []chat.ReactionCount{{Emoji: "👍", Count: 1, Me: true}}, got.Messages[0].Reactions)
+	require.Len(t, got.Pinned, 1)
+	require.NotNil(t, got.Unread)
+
+	var plain pollResp
+	status, body = doJSON(t, http.MethodGet, fmt.Sprintf("%s/chats/%d", srv.URL, chatID), nil)
+	require.Equal(t, http.StatusOK, status)
+	require.NoError(t, json.Unmarshal(body, &plain))
+	require.Equal(t, plain.Messages, got.Messages)
+
+	// новых нет: запрос ждет, пока в чат не напишут
+	type result struct {
+		status int
+		body   []byte
+	}
+	done := make(chan result, 1)
+	start := time.Now()
+	go func() {
+		status, body := doJSON(t, http.MethodGet, fmt.Sprintf("%s/chats/%d?after_id=%d&wait=20s", srv.URL, chatID, first), nil)
+		done <- result{status, body}
+	}()
+
+	time.Sleep(300 * time.Millisecond)
+	second := createMessage(t, srv.URL, chatID, "two")
+
+	res := <-done
+	require.Equal(t, http.StatusOK, res.status)
+	require.Less(t, time.Since(start), 10*time.Second)
+	got = pollResp{}
+	require.NoError(t, json.Unmarshal(res.body, &got))
+	require.Len(t, got.Messages, 1)
+	require.Equal(t, second, got.Messages[0].ID)
+
+	// по таймауту пустой список
+	status, body = doJSON(t, http.MethodGet, fmt.Sprintf("%s/chats/%d?after_id=%d&wait=1", srv.URL, chatID, second), nil)
+	require.Equal(t, http.StatusOK, status)
+	got = pollResp{}
+	require.NoError(t, json.Unmarshal(body, &got))
+	require.Empty(t, got.Messages)
+
+	status, _ = doJSON(t, http.MethodGet, fmt.Sprintf("%s/chats/%d?after_id=1&wait=5m", srv.URL, chatID), nil)
+	require.Equal(t, http.StatusBadRequest, status)
+
+	// wait без after_id не отдает начало истории вместо новых сообщений
+	status, _ = doJSON(t, http.MethodGet, fmt.Sprintf("%s/chats/%d?wait=1", srv.URL, chatID), nil)
+	require.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestChatAPI_SearchMessages(t *testing.T) {
+
+	srv, db := startTestServer(t)
+	defer srv.Close()
+
+	chatID := createChat(t, srv.URL, "search")
+	first := createMessage(t, srv.URL, chatID, "встреча завтра в офисе")
+	second := createMessage(t, srv.URL, chatID, "<b>Встречи</b> по понедельникам")
+	createMessage(t, srv.URL, chatID, "обсуждаем релиз")
+
+	// чужой чат в глобальный поиск не попадает
+	stranger := tokenFor(t, createUser(t, db, "stranger"))
+	status, body := doJSONAs(t, stranger, http.MethodPost, srv.URL+"/chats/", map[string]any{"title": "other"})
+	require.Equal(t, http.StatusCreated, status)
+	var other chat.Chat
+	require.NoError(t, json.Unmarshal(body, &other))
+	status, _ = doJSONAs(t, stranger, http.MethodPost, fmt.Sprintf("%s/chats/%d/messages/", srv.URL, other.ID), map[string]any{"text": "встреча у чужих"})
+	require.Equal(t, http.StatusCreated, status)
+
+	type searchResp struct {
+		Results    []chat.SearchHit `json:"results"`
+		NextCursor string           `json:"next_cursor"`
+	}
+
+	// слово ищется по основе, подсветка в <mark>, html из текста экранирован
+	status, body = doJSON(t, http.MethodGet, fmt.Sprintf("%s/chats/%d/messages/search?q=%s", srv.URL, chatID, url.QueryEscape("встреча")), nil)
+	require.Equal(t, http.StatusOK, status)
+	var got searchResp
+	require.NoError(t, json.Unmarshal(body, &got))
+	require.Len(t, got.Results, 2)
+	ids := []int64{got.Results[0].ID, got.Results[1].ID}
+	require.ElementsMatch(t, []int64{first, second}, ids)
+	for _, h := range got.Results {
+		require.Contains(t, h.Snippet, "<mark>")
+		require.NotContains(t, h.Snippet, "<b>")
+		require.NotNil(t, h.Author)
+	}
+
+	// страницы по одному результату без повторов
+	status, body = doJSON(t, http.MethodGet, srv.URL+"/search?limit=1&q="+url.QueryEscape("встреча"), nil)
+	require.Equal(t, http.StatusOK, status)
+	var page1 searchResp
+	require.NoError(t, json.Unmarshal(body, &page1))
+	require.Len(t, page1.Results, 1)
+	require.NotEmpty(t, page1.NextCursor)
+
+	status, body = doJSON(t, http.MethodGet, srv.URL+"/search?limit=1&q="+url.QueryEscape("встреча")+"&cursor="+page1.NextCursor, nil)
+	require.Equal(t, http.StatusOK, status)
+	var page2 searchResp
+	require.NoError(t, json.Unmarshal(body, &page2))
+	require.Len(t, page2.Results, 1)
+	require.Empty(t, page2.NextCursor)
+	require.ElementsMatch(t, []int64{first, second}, []int64{page1.Results[0].ID, page2.Results[0].ID})
+
+	// пустой запрос не проходит валидацию
+	status, _ = doJSON(t, http.MethodGet, srv.URL+"/search?q=%20%20", nil)
+	require.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestChatAPI_IdempotencyKey(t *testing.T) {
+
+	srv, db := startTestServer(t)
+	defer srv.Close()
+
+	post := func(token, url, key string, payload any) (int, []byte, http.Header) {
+		t.Helper()
+		b, err := json.Marshal(payload)
+		require.NoError(t, err)
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, body, resp.Header
+	}
+
+	// повтор создания чата отдает тот же ответ и не создает второй чат
+	status, first, _ := post(testToken, srv.URL+"/chats/", "chat-1", map[string]any{"title": "retry"})
+	require.Equal(t, http.StatusCreated, status)
+	status, again, h := post(testToken, srv.URL+"/chats/", "chat-1", map[string]any{"title": "retry"})
+	require.Equal(t, http.StatusCreated, status)
+	require.Equal(t, "true", h.Get("Idempotent-Replayed"))
+	require.JSONEq(t, string(first), string(again))
+
+	var c chat.Chat
+	require.NoError(t, json.Unmarshal(first, &c))
+	var chats int
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM chats`).Scan(&chats))
+	require.Equal(t, 1, chats)
+
+	// то же для сообщений
+	msgURL := fmt.Sprintf("%s/chats/%d/messages/", srv.URL, c.ID)
+	status, first, _ = post(testToken, msgURL, "msg-1", map[string]any{"text": "hello"})
+	require.Equal(t, http.StatusCreated, status)
+	status, again, _ = post(testToken, msgURL, "msg-1", map[string]any{"text": "hello"})
+	require.Equal(t, http.StatusCreated, status)
+	require.JSONEq(t, string(first), string(again))
+	var msgs int
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM messages`).Scan(&msgs))
+	require.Equal(t, 1, msgs)
+
+	// тот же ключ с другим телом 422
+	status, _, _ = post(testToken, msgURL, "msg-1", map[string]any{"text": "other"})
+	require.Equal(t, http.StatusUnprocessableEntity, status)
+
+	// у другого пользователя свои ключи
+	other := tokenFor(t, createUser(t, db, "other"))
+	status, _, _ = post(other, srv.URL+"/chats/", "chat-1", map[string]any{"title": "retry"})
+	require.Equal(t, http.StatusCreated, status)
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM chats`).Scan(&chats))
+	require.Equal(t, 2, chats)
+}
+
+func TestChatAPI_CreateMessageClientID(t *testing.T) {
+
+	srv, db := startTestServer(t)
+	defer srv.Close()
+
+	chatID := createChat(t, srv.URL, "offline")
+	msgURL := fmt.Sprintf("%s/chats/%d/messages/", srv.URL, chatID)
+	clientID := "6F9619FF-8B86-D011-B42D-00C04FC964FF"
+
+	status, body := doJSON(t, http.MethodPost, msgURL, map[string]any{"text": "hi", "client_id": clientID})
+	require.Equal(t, http.StatusCreated, status)
+	var first chat.Message
+	require.NoError(t, json.Unmarshal(body, &first))
+	require.NotNil(t, first.ClientID)
+	require.Equal(t, strings.ToLower(clientID), *first.ClientID)
+
+	// повтор с тем же client_id возвращает то же сообщение, даже если текст другой
+	status, body = doJSON(t, http.MethodPost, msgURL, map[string]any{"text": "hi again", "client_id": clientID})
+	require.Equal(t, http.StatusOK, status)
+	var again chat.Message
+	require.NoError(t, json.Unmarshal(body, &again))
+	require.Equal(t, first.ID, again.ID)
+	require.Equal(t, "hi", again.Text)
+	require.NotNil(t, again.Author)
+
+	var n int
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM messages`).Scan(&n))
+	require.Equal(t, 1, n)
+
+	// тот же client_id в другом чате это другое сообщение
+	otherChat := createChat(t, srv.URL, "other")
+	status, _ = doJSON(t, http.MethodPost, fmt.Sprintf("%s/chats/%d/messages/", srv.URL, otherChat), map[string]any{"text": "hi", "client_id": clientID})
+	require.Equal(t, http.StatusCreated, status)
+
+	// чужой client_id в том же чате 409
+	memberID := createUser(t, db, "member")
+	status, _ = doJSON(t, http.MethodPost, fmt.Sprintf("%s/chats/%d/members", srv.URL, chatID), map[string]any{"user_id": memberID})
+	require.Equal(t, http.StatusCreated, status)
+	status, _ = doJSONAs(t, tokenFor(t, memberID), http.MethodPost, msgURL, map[string]any{"text": "hi", "client_id": clientID})
+	require.Equal(t, http.StatusConflict, status)
+
+	status, _ = doJSON(t, http.MethodPost, msgURL, map[string]any{"text": "hi", "client_id": "not-a-uuid"})
+	require.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestChatAPI_CreateMessagesBatch(t *testing.T) {
+
+	srv, db := startTestServer(t)
+	defer srv.Close()
+
+	chatID := createChat(t, srv.URL, "import")
+	batchURL := fmt.Sprintf("%s/chats/%d/messages:batch", srv.URL, chatID)
+
+	type itemResult struct {
+		Index   int           `json:"index"`
+		Status  int           `json:"status"`
+		Message *chat.Message `json:"message"`
+		Error   string        `json:"error"`
+	}
+	type batchResp struct {
+		Error   string       `json:"error"`
+		Failed  int          `json:"failed"`
+		Results []itemResult `json:"results"`
+	}
+	count := func() int {
+		var n int
+		require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM messages`).Scan(&n))
+		return n
+	}
+
+	// atomic: одна ошибка и не создано ничего
+	status, body := doJSON(t, http.MethodPost, batchURL, map[string]any{
+		"messages": []map[string]any{{"text": "one"}, {"text": "   "}, {"text": "three"}},
+	})
+	require.Equal(t, http.StatusBadRequest, status)
+	var got batchResp
+	require.NoError(t, json.Unmarshal(body, &got))
+	require.Len(t, got.Results, 1)
+	require.Equal(t, 1, got.Results[0].Index)
+	require.Equal(t, http.StatusBadRequest, got.Results[0].Status)
+	require.Equal(t, 0, count())
+
+	// partial: валидные создаются по порядку, ошибка по индексу
+	status, body = doJSON(t, http.MethodPost, batchURL, map[string]any{
+		"mode":     "partial",
+		"messages": []map[string]any{{"text": "one"}, {"text": "   "}, {"text": "three"}},
+	})
+	require.Equal(t, http.StatusMultiStatus, status)
+	got = batchResp{}
+	require.NoError(t, json.Unmarshal(body, &got))
+	require.Equal(t, 1, got.Failed)
+	require.Len(t, got.Results, 3)
+	require.Equal(t, http.StatusCreated, got.Results[0].Status)
+	require.Equal(t, "one", got.Results[0].Message.Text)
+	require.Equal(t, http.StatusBadRequest, got.Results[1].Status)
+	require.NotEmpty(t, got.Results[1].Error)
+	require.Equal(t, http.StatusCreated, got.Results[2].Status)
+	require.Less(t, got.Results[0].Message.ID, got.Results[2].Message.ID)
+	require.Equal(t, 2, count())
+
+	// client_id работает так же, как в одиночном POST
+	clientID := "6f9619ff-8b86-d011-b42d-00c04fc964ff"
+	status, body = doJSON(t, http.MethodPost, batchURL, map[string]any{
+		"messages": []map[string]any{{"text": "a", "client_id": clientID}, {"text": "a", "client_id": clientID}},
+	})
+	require.Equal(t, http.StatusOK, status)
+	got = batchResp{}
+	require.NoError(t, json.Unmarshal(body, &got))
+	require.Equal(t, http.StatusCreated, got.Results[0].Status)
+	require.Equal(t, http.StatusOK, got.Results[1].Status)
+	require.Equal(t, got.Results[0].Message.ID, got.Results[1].Message.ID)
+	require.Equal(t, 0, got.Failed)
+	require.Equal(t, 3, count())
+
+	// пустая пачка и чужой чат, чужому 403 даже на невалидные сообщения
+	status, _ = doJSON(t, http.MethodPost, batchURL, map[string]any{"messages": []map[string]any{}})
+	require.Equal(t, http.StatusBadRequest, status)
+	stranger := tokenFor(t, createUser(t, db, "stranger"))
+	status, _ = doJSONAs(t, stranger, http.MethodPost, batchURL, map[string]any{"messages": []map[string]any{{"text": "x"}}})
+	require.Equal(t, http.StatusForbidden, status)
+	status, body = doJSONAs(t, stranger, http.MethodPost, batchURL, map[string]any{"messages": []map[string]any{{"text": "   "}}})
+	require.Equal(t, http.StatusForbidden, status)
+	got = batchResp{}
+	require.NoError(t, json.Unmarshal(body, &got))
+	require.Empty(t, got.Results)
+}
+
+func TestChatAPI_MessageReplies(t *testing.T) {
+
+	srv, _ := startTestServer(t)
+	defer srv.Close()
+
+	chatID := createChat(t, srv.URL, "threads")
+	root := createMessage(t, srv.URL, chatID, "root")
+	createMessage(t, srv.URL, chatID, "plain")
+	msgsURL := fmt.Sprintf("%s/chats/%d/messages/", srv.URL, chatID)
+
+	var replies []int64
+	for i := 0; i < 3; i++ {
+		status, body := doJSON(t, http.MethodPost, msgsURL, map[string]any{"text": fmt.Sprintf("reply %d", i), "parent_id": root})
+		require.Equal(t, http.StatusCreated, status)
+		var m chat.Message
+		require.NoError(t, json.Unmarshal(body, &m))
+		require.NotNil(t, m.ParentID)
+		require.Equal(t, root, *m.ParentID)
+		replies = append(replies, m.ID)
+	}
+
+	// reply_count у корневых сообщений в GetChat, у ответов его нет
+	status, body := doJSON(t, http.MethodGet, fmt.Sprintf("%s/chats/%d?limit=100", srv.URL, chatID), nil)
+	require.Equal(t, http.StatusOK, status)
+	var got struct {
+		Messages []chat.Message `json:"messages"`
+	}
+	require.NoError(t, json.Unmarshal(body, &got))
+	require.Len(t, got.Messages, 5)
+	for _, m := range got.Messages {
+		switch {
+		case m.ID == root:
+			require.NotNil(t, m.ReplyCount)
+			require.Equal(t, 3, *m.ReplyCount)
+		case m.ParentID == nil:
+			require.NotNil(t, m.ReplyCount)
+			require.Equal(t, 0, *m.ReplyCount)
+		default:
+			require.Nil(t, m.ReplyCount)
+		}
+	}
+
+	// страницы ответов по порядку
+	status, body = doJSON(t, http.MethodGet, fmt.Sprintf("%s/chats/%d/messages/%d/replies?limit=2", srv.URL, chatID, root), nil)
+	require.Equal(t, http.StatusOK, status)
+	var page struct {
+		Messages   []chat.Message `json:"messages"`
+		NextCursor string         `json:"next_cursor"`
+	}
+	require.NoError(t, json.Unmarshal(body, &page))
+	require.Len(t, page.Messages, 2)
+	require.Equal(t, replies[0], page.Messages[0].ID)
+	require.Equal(t, replies[1], page.Messages[1].ID)
+	require.NotEmpty(t, page.NextCursor)
+
+	status, body = doJSON(t, http.MethodGet, fmt.Sprintf("%s/chats/%d/messages/%d/replies?limit=2&after=%s", srv.URL, chatID, root, page.NextCursor), nil)
+	require.Equal(t, http.StatusOK, status)
+	page.NextCursor = ""
+	require.NoError(t, json.Unmarshal(body, &page))
+	require.Len(t, page.Messages, 1)
+	require.Equal(t, replies[2], page.Messages[0].ID)
+	require.Empty(t, page.NextCursor)
+
+	// ответ на сообщение из другого чата и ответ на ответ отклоняются
+	otherChat := createChat(t, srv.URL, "other")
+	foreign := createMessage(t, srv.URL, otherChat, "elsewhere")
+	status, _ = doJSON(t, http.MethodPost, msgsURL, map[string]any{"text": "x", "parent_id": foreign})
+	require.Equal(t, http.StatusBadRequest, status)
+	status, _ = doJSON(t, http.MethodPost, msgsURL, map[string]any{"text": "x", "parent_id": replies[0]})
+	require.Equal(t, http.StatusBadRequest, status)
+
+	status, _ = doJSON(t, http.MethodGet, fmt.Sprintf("%s/chats/%d/messages/%d/replies", srv.URL, chatID, foreign), nil)
+	require.Equal(t, http.StatusNotFound, status)
+}
+
+func TestChatAPI_MessageReactions(t *testing.T) {
+
+	srv, db := startTestServer(t)
+	defer srv.Close()
+
+	chatID := createChat(t, srv.URL, "reactions")
+	first := createMessage(t, srv.URL, chatID, "first")
+	second := createMessage(t, srv.URL, chatID, "second")
+	reactionURL := func(msgID int64, emoji string) string {
+		return fmt.Sprintf("%s/chats/%d/messages/%d/reactions/%s", srv.URL, chatID, msgID, url.PathEscape(emoji))
+	}
+
+	memberID := createUser(t, db, "member")
+	status, _ := doJSON(t, http.MethodPost, fmt.Sprintf("%s/chats/%d/members", srv.URL, chatID), map[string]any{"user_id": memberID})
+	require.Equal(t, http.StatusCreated, status)
+	member := tokenFor(t, memberID)
+
+	type reactionsResp struct {
+		Reactions []chat.ReactionCount `json:"reactions"`
+	}
+
+	status, body := doJSON(t, http.MethodPut, reactionURL(first, "👍"), nil)
+	require.Equal(t, http.StatusCreated, status)
+	var got reactionsResp
+	require.NoError(t, json.Unmarshal(body, &got))
+	require.Equal(t, []chat.ReactionCount{{Emoji: "👍", Count: 1, Me: true}}, got.Reactions)
+
+	// повтор той же реакции ничего не меняет
+	status, _ = doJSON(t, http.MethodPut, reactionURL(first, "👍"), nil)
+	require.Equal(t, http.StatusOK, status)
+
+	status, _ = doJSONAs(t, member, http.MethodPut, reactionURL(first, "👍"), nil)
+	require.Equal(t, http.StatusCreated, status)
+	status, _ = doJSONAs(t, member, http.MethodPut, reactionURL(first, "🎉"), nil)
+	require.Equal(t, http.StatusCreated, status)
+
+	// счетчики приходят вместе со страницей сообщений
+	status, body = doJSON(t, http.MethodGet, fmt.Sprintf("%s/chats/%d", srv.URL, chatID), nil)
+	require.Equal(t, http.StatusOK, status)
+	var page struct {
+		Messages []chat.Message `json:"messages"`
+	}
+	require.NoError(t, json.Unmarshal(body, &page))
+	require.Len(t, page.Messages, 2)
+	require.Equal(t, first, page.Messages[0].ID)
+	require.Equal(t, []chat.ReactionCount{{Emoji: "👍", Count: 2, Me: true}, {Emoji: "🎉", Count: 1, Me: false}}, page.Messages[0].Reactions)
+	require.Equal(t, second, page.Messages[1].ID)
+	require.Empty(t, page.Messages[1].Reactions)
+
+	// снять можно только свою реакцию
+	status, _ = doJSON(t, http.MethodDelete, reactionURL(first, "🎉"), nil)
+	require.Equal(t, http.StatusNotFound, status)
+	status, _ = doJSONAs(t, member, http.MethodDelete, reactionURL(first, "🎉"), nil)
+	require.Equal(t, http.StatusNoContent, status)
+
+	status, _ = doJSON(t, http.MethodPut, reactionURL(first, "a b"), nil)
+	require.Equal(t, http.StatusBadRequest, status)
+
+	// реакции удаленного сообщения удаляются вместе с текстом, новые не ставятся
+	status, _ = doJSON(t, http.MethodDelete, fmt.Sprintf("%s/chats/%d/messages/%d", srv.URL, chatID, first), nil)
+	require.Equal(t, http.StatusNoContent, status)
+	var left int
+	require.NoError(t, db.QueryRowContext(context.Background(), "SELECT COUNT(*) FROM message_reactions WHERE message_id = $1", first).Scan(&left))
+	require.Zero(t, left)
+	status, _ = doJSON(t, http.MethodPut, reactionURL(first, "👍"), nil)
+	require.Equal(t, http.StatusNotFound, status)
+}
+
+// Предел закрепленных сообщений в тестовом сервере
+const testPinLimit = 2
+
+func TestChatAPI_PinnedMessages(t *testing.T) {
+
+	srv, db := startTestServer(t)
+	defer srv.Close()
+
+	chatID := createChat(t, srv.URL, "pins")
+	first := createMessage(t, srv.URL, chatID, "first")
+	second := createMessage(t, srv.URL, chatID, "second")
+	third := createMessage(t, srv.URL, chatID, "third")
+	pinURL := func(msgID int64) string {
+		return fmt.Sprintf("%s/chats/%d/messages/%d/pin", srv.URL, chatID, msgID)
+	}
+
+	status, body := doJSON(t, http.MethodPut, pinURL(first), nil)
+	require.Equal(t, http.StatusCreated, status)
+	var pin chat.Pin
+	require.NoError(t, json.Unmarshal(body, &pin))
+	require.Equal(t, first, pin.MessageID)
+	require.NotNil(t, pin.PinnedBy)
+	require.NotNil(t, pin.Message)
+	require.Equal(t, "first", pin.Message.Text)
+
+	// повторное закрепление ничего не меняет
+	status, _ = doJSON(t, http.MethodPut, pinURL(first), nil)
+	require.Equal(t, http.StatusOK, status)
+
+	status, _ = doJSON(t, http.MethodPut, pinURL(second), nil)
+	require.Equal(t, http.StatusCreated, status)
+
+	// сверх предела 409
+	status, _ = doJSON(t, http.MethodPut, pinURL(third), nil)
+	require.Equal(t, http.StatusConflict, status)
+
+	// реакция на закрепленное видна и в pinned, сообщения там такие же, как в истории
+	status, _ = doJSON(t, http.MethodPut, fmt.Sprintf("%s/chats/%d/messages/%d/reactions/%s", srv.URL, chatID, first, url.PathEscape("👍")), nil)
+	require.Equal(t, http.StatusCreated, status)
+
+	// pinned в GET /chats/{id}, последние закрепленные первыми
+	status, body = doJSON(t, http.MethodGet, fmt.Sprintf("%s/chats/%d", srv.URL, chatID), nil)
+	require.Equal(t, http.StatusOK, status)
+	var got struct {
+		Pinned []chat.Pin `json:"pinned"`
+	}
+	require.NoError(t, json.Unmarshal(body, &got))
+	require.Len(t, got.Pinned, 2)
+	require.Equal(t, second, got.Pinned[0].MessageID)
+	require.Equal(t, first, got.Pinned[1].MessageID)
+	require.NotNil(t, got.Pinned[0].Message.Author)
+	require.Equal(t, []chat.ReactionCount{{Emoji: "👍", Count: 1, Me: true}}, got.Pinned[1].Message.Reactions)
+	require.NotNil(t, got.Pinned[1].Message.ReplyCount)
+
+	// удаленное сообщение открепляется, место освобождается
+	status, _ = doJSON(t, http.MethodDelete, fmt.Sprintf("%s/chats/%d/messages/%d", srv.URL, chatID, second), nil)
+	require.Equal(t, http.StatusNoContent, status)
+	status, _ = doJSON(t, http.MethodPut, pinURL(third), nil)
+	require.Equal(t, http.StatusCreated, status)
+
+	status, _ = doJSON(t, http.MethodDelete, pinURL(first), nil)
+	require.Equal(t, http.StatusNoContent, status)
+	status, _ = doJSON(t, http.MethodDelete, pinURL(first), nil)
+	require.Equal(t, http.StatusNotFound, status)
+
+	// обычный участник закреплять не может
+	memberID := createUser(t, db, "member")
+	status, _ = doJSON(t, http.MethodPost, fmt.Sprintf("%s/chats/%d/members", srv.URL, chatID), map[string]any{"user_id": memberID})
+	require.Equal(t, http.StatusCreated, status)
+	status, _ = doJSONAs(t, tokenFor(t, memberID), http.MethodPut, pinURL(first), nil)
+	require.Equal(t, http.StatusForbidden, status)
+}
+
+func TestChatAPI_ReadReceipts(t *testing.T) {
+
+	srv, db := startTestServer(t)
+	defer srv.Close()
+
+	chatID := createChat(t, srv.URL, "reads")
+	readerID := createUser(t, db, "reader")
+	status, _ := doJSON(t, http.MethodPost, fmt.Sprintf("%s/chats/%d/members", srv.URL, chatID), map[string]any{"user_id": readerID})
+	require.Equal(t, http.StatusCreated, status)
+	reader := tokenFor(t, readerID)
+
+	var ids []int64
+	for i := 0; i < 3; i++ {
+		ids = append(ids, createMessage(t, srv.URL, chatID, fmt.Sprintf("m%d", i)))
+	}
+
+	type readResp struct {
+		LastReadMessageID int64 `json:"last_read_message_id"`
+		UnreadCount       int64 `json:"unread_count"`
+	}
+	chatState := func(token string) readResp {
+		t.Helper()
+		status, body := doJSONAs(t, token, http.MethodGet, fmt.Sprintf("%s/chats/%d", srv.URL, chatID), nil)
+		require.Equal(t, http.StatusOK, status)
+		var st readResp
+		require.NoError(t, json.Unmarshal(body, &st))
+		return st
+	}
+
+	// свои сообщения не считаются непрочитанными
+	require.Equal(t, int64(0), chatState(testToken).UnreadCount)
+	require.Equal(t, readResp{LastReadMessageID: 0, UnreadCount: 3}, chatState(reader))
+
+	readURL := fmt.Sprintf("%s/chats/%d/read", srv.URL, chatID)
+	status, body := doJSONAs(t, reader, http.MethodPost, readURL, map[string]any{"message_id": ids[1]})
+	require.Equal(t, http.StatusOK, status)
+	var st readResp
+	require.NoError(t, json.Unmarshal(body, &st))
+	require.Equal(t, readResp{LastReadMessageID: ids[1], UnreadCount: 1}, st)
+
+	// назад позиция не двигается
+	status, body = doJSONAs(t, reader, http.MethodPost, readURL, map[string]any{"message_id": ids[0]})
+	require.Equal(t, http.StatusOK, status)
+	require.NoError(t, json.Unmarshal(body, &st))
+	require.Equal(t, readResp{LastReadMessageID: ids[1], UnreadCount: 1}, st)
+
+	// unread_count в списке чатов
+	status, body = doJSONAs(t, reader, http.MethodGet, srv.URL+"/chats", nil)
+	require.Equal(t, http.StatusOK, status)
+	var list struct {
+		Chats []chat.ChatSummary `json:"chats"`
+	}
+	require.NoError(t, json.Unmarshal(body, &list))
+	require.Len(t, list.Chats, 1)
+	require.Equal(t, int64(1), list.Chats[0].UnreadCount)
+	require.Equal(t, ids[1], list.Chats[0].LastReadMessageID)
+
+	// без message_id до последнего сообщения
+	status, _ = doRawAs(t, reader, http.MethodPost, readURL, nil)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, readResp{LastReadMessageID: ids[2], UnreadCount: 0}, chatState(reader))
+
+	// сообщение из другого чата
+	other := createMessage(t, srv.URL, createChat(t, srv.URL, "other"), "x")
+	status, _ = doJSONAs(t, reader, http.MethodPost, readURL, map[string]any{"message_id": other})
+	require.Equal(t, http.StatusNotFound, status)
+}
+
+// Предел размера вложения в тестовом сервере, больше 1 МБ лимита JSON
+const testAttachmentMax = 2 << 20
+
+// Проверка вложений: загрузка потоком больше 1 МБ, определение типа, предел размера, привязка к сообщению и скачивание
+func TestChatAPI_Attachments(t *testing.T) {
+
+	srv, db := startTestServer(t)
+	defer srv.Close()
+
+	chatID := createChat(t, srv.URL, "files")
+	readerID := createUser(t, db, "reader")
+	status, _ := doJSON(t, http.MethodPost, fmt.Sprintf("%s/chats/%d/members", srv.URL, chatID), map[string]any{"user_id": readerID, "role": "read-only"})
+	require.Equal(t, http.StatusCreated, status)
+	reader := tokenFor(t, readerID)
+	uploadURL := fmt.Sprintf("%s/chats/%d/attachments", srv.URL, chatID)
+
+	// PNG по сигнатуре, заявленный клиентом тип игнорируется
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 1536<<10)...)
+	req, err := http.NewRequest(http.MethodPost, uploadURL+"?filename=../photo.png", bytes.NewReader(png))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	req.Header.Set("Content-Type", "text/html")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	var image chat.Attachment
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&image))
+	_ = resp.Body.Close()
+	require.Equal(t, "photo.png", image.Filename)
+	require.Equal(t, "image/png", image.ContentType)
+	require.Equal(t, int64(len(png)), image.Size)
+	require.Nil(t, image.MessageID)
+
+	// multipart с полем file
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	fw, err := mw.CreateFormFile("file", "notes.txt")
+	require.NoError(t, err)
+	_, _ = fw.Write([]byte("just some notes"))
+	require.NoError(t, mw.Close())
+	req, err = http.NewRequest(http.MethodPost, uploadURL, &form)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	var notes chat.Attachment
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&notes))
+	_ = resp.Body.Close()
+	require.Equal(t, "notes.txt", notes.Filename)
+	require.Equal(t, "text/plain; charset=utf-8", notes.ContentType)
+
+	// больше предела 413, пустой файл 400, read-only загружать не может
+	status, _ = doRaw(t, http.MethodPost, uploadURL, bytes.Repeat([]byte("a"), testAttachmentMax+1))
+	require.Equal(t, http.StatusRequestEntityTooLarge, status)
+	status, _ = doRaw(t, http.MethodPost, uploadURL, nil)
+	require.Equal(t, http.StatusBadRequest, status)
+	status, _ = doRawAs(t, reader, http.MethodPost, uploadURL, []byte("x"))
+	require.Equal(t, http.StatusForbidden, status)
+
+	// непривязанное вложение видит только загрузивший
+	imageURL := srv.URL + image.URL
+	status, _ = doRawAs(t, reader, http.MethodGet, imageURL, nil)
+	require.Equal(t, http.StatusNotFound, status)
+
+	// сообщение только с вложениями, без текста
+	msgURL := fmt.Sprintf("%s/chats/%d/messages", srv.URL, chatID)
+	status, body := doJSON(t, http.MethodPost, msgURL, map[string]any{"attachment_ids": []int64{image.ID, notes.ID, image.ID}})
+	require.Equal(t, http.StatusCreated, status)
+	var m chat.Message
+	require.NoError(t, json.Unmarshal(body, &m))
+	require.Empty(t, m.Text)
+	require.Len(t, m.Attachments, 2)
+	require.Equal(t, image.ID, m.Attachments[0].ID)
+	require.Equal(t, notes.ID, m.Attachments[1].ID)
+
+	// повторно привязать нельзя
+	status, _ = doJSON(t, http.MethodPost, msgURL, map[string]any{"text": "again", "attachment_ids": []int64{notes.ID}})
+	require.Equal(t, http.StatusBadRequest, status)
+
+	// вложения приходят в истории и скачиваются участниками
+	status, body = doJSONAs(t, reader, http.MethodGet, msgURL, nil)
+	require.Equal(t, http.StatusOK, status)
+	var page struct {
+		Messages []chat.Message `json:"messages"`
+	}
+	require.NoError(t, json.Unmarshal(body, &page))
+	require.Len(t, page.Messages, 1)
+	require.Len(t, page.Messages[0].Attachments, 2)
+
+	req, err = http.NewRequest(http.MethodGet, imageURL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+reader)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	got, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+	require.Equal(t, "nosniff", resp.Header.Get("X-Content-Type-Options"))
+	require.Equal(t, png, got)
+
+	blobFiles := func() []string {
+		var files []string
+		require.NoError(t, filepath.WalkDir(testBlobDir, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				files = append(files, path)
+			}
+			return err
+		}))
+		return files
+	}
+
+	// не участнику 403, после удаления сообщения вложения недоступны, а их файлы уходят из хранилища
+	stranger := tokenFor(t, createUser(t, db, "stranger"))
+	status, _ = doRawAs(t, stranger, http.MethodGet, imageURL, nil)
+	require.Equal(t, http.StatusForbidden, status)
+	status, _ = doRaw(t, http.MethodDelete, fmt.Sprintf("%s/%d", msgURL, m.ID), nil)
+	require.Equal(t, http.StatusNoContent, status)
+	status, _ = doRawAs(t, reader, http.MethodGet, imageURL, nil)
+	require.Equal(t, http.StatusNotFound, status)
+	require.Eventually(t, func() bool { return len(blobFiles()) == 0 }, 5*time.Second, 50*time.Millisecond)
+
+	// вместе с чатом из хранилища уходят и файлы
+	status, body = doRaw(t, http.MethodPost, uploadURL+"?filename=left.txt", []byte("left"))
+	require.Equal(t, http.StatusCreated, status)
+	var left chat.Attachment
+	require.NoError(t, json.Unmarshal(body, &left))
+	status, _ = doJSON(t, http.MethodPost, msgURL, map[string]any{"attachment_ids": []int64{left.ID}})
+	require.Equal(t, http.StatusCreated, status)
+	require.Len(t, blobFiles(), 1)
+	status, _ = doRaw(t, http.MethodDelete, fmt.Sprintf("%s/chats/%d", srv.URL, chatID), nil)
+	require.Equal(t, http.StatusNoContent, status)
+	require.Empty(t, blobFiles())
+}
+
+// Длинная сторона превью в тестовом сервере
+const testThumbnailSide = 64
+
+// Превью картинок: пока воркер работает, сообщение в processing, потом у вложения thumbnail_url
+func TestChatAPI_AttachmentThumbnails(t *testing.T) {
+
+	srv, _ := startTestServer(t)
+	defer srv.Close()
+
+	chatID := createChat(t, srv.URL, "thumbs")
+	uploadURL := fmt.Sprintf("%s/chats/%d/attachments", srv.URL, chatID)
+
+	var img bytes.Buffer
+	require.NoError(t, jpeg.Encode(&img, image.NewRGBA(image.Rect(0, 0, 400, 300)), nil))
+	status, body := doRaw(t, http.MethodPost, uploadURL+"?filename=cat.jpg", img.Bytes())
+	require.Equal(t, http.StatusCreated, status)
+	var photo chat.Attachment
+	require.NoError(t, json.Unmarshal(body, &photo))
+	require.Equal(t, "image/jpeg", photo.ContentType)
+	require.Contains(t, []string{chat.ThumbnailProcessing, chat.ThumbnailReady}, photo.ThumbnailState)
+
+	// у не-картинки превью нет совсем
+	status, body = doRaw(t, http.MethodPost, uploadURL+"?filename=a.txt", []byte("plain text"))
+	require.Equal(t, http.StatusCreated, status)
+	var doc chat.Attachment
+	require.NoError(t, json.Unmarshal(body, &doc))
+	require.Empty(t, doc.ThumbnailState)
+	require.Empty(t, doc.ThumbnailURL)
+
+	// битая картинка с сигнатурой PNG отмечается failed
+	status, body = doRaw(t, http.MethodPost, uploadURL+"?filename=broken.png", []byte("\x89PNG\r\n\x1a\nbroken"))
+	require.Equal(t, http.StatusCreated, status)
+	var broken chat.Attachment
+	require.NoError(t, json.Unmarshal(body, &broken))
+
+	msgURL := fmt.Sprintf("%s/chats/%d/messages", srv.URL, chatID)
+	status, body = doJSON(t, http.MethodPost, msgURL, map[string]any{"text": "look", "attachment_ids": []int64{photo.ID, doc.ID, broken.ID}})
+	require.Equal(t, http.StatusCreated, status)
+	var m chat.Message
+	require.NoError(t, json.Unmarshal(body, &m))
+
+	// ждем, пока воркеры закончат
+	deadline := time.Now().Add(10 * time.Second)
+	for m.State == chat.MessageProcessing {
+		require.True(t, time.Now().Before(deadline), "thumbnails are still processing")
+		time.Sleep(50 * time.Millisecond)
+		status, body = doJSON(t, http.MethodGet, msgURL, nil)
+		require.Equal(t, http.StatusOK, status)
+		var page struct {
+			Messages []chat.Message `json:"messages"`
+		}
+		require.NoError(t, json.Unmarshal(body, &page))
+		require.Len(t, page.Messages, 1)
+		m = page.Messages[0]
+	}
+	require.Len(t, m.Attachments, 3)
+	require.Equal(t, chat.ThumbnailReady, m.Attachments[0].ThumbnailState)
+	require.Equal(t, photo.URL+"/thumbnail", m.Attachments[0].ThumbnailURL)
+	require.Empty(t, m.Attachments[1].ThumbnailState)
+	require.Equal(t, chat.ThumbnailFailed, m.Attachments[2].ThumbnailState)
+	require.Empty(t, m.Attachments[2].ThumbnailURL)
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+m.Attachments[0].ThumbnailURL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "image/jpeg", resp.Header.Get("Content-Type"))
+	cfg, err := jpeg.DecodeConfig(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, testThumbnailSide, cfg.Width)
+	require.Equal(t, testThumbnailSide*3/4, cfg.Height)
+
+	status, _ = doRaw(t, http.MethodGet, srv.URL+m.Attachments[2].URL+"/thumbnail", nil)
+	require.Equal(t, http.StatusNotFound, status)
+}
+
+// Превью ссылок: после отправки сообщение получает link_previews со страницы по ссылке
+func TestChatAPI_LinkPreviews(t *testing.T) {
+
+	page := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = io.WriteString(w, `<html><head><title>Fallback</title>
+<meta property="og:title" content="Статья">
+<meta property="og:description" content="Описание статьи">
+<meta property="og:image" content="/cover.png">
+</head><body>text</body></html>`)
+	}))
+	defer page.Close()
+
+	srv, _ := startTestServer(t)
+	defer srv.Close()
+
+	chatID := createChat(t, srv.URL, "links")
+	msgURL := fmt.Sprintf("%s/chats/%d/messages", srv.URL, chatID)
+	link := page.URL + "/post?id=1"
+	status, body := doJSON(t, http.MethodPost, msgURL, map[string]any{"text": "смотри (" + link + "), без ссылки: http://"})
+	require.Equal(t, http.StatusCreated, status)
+	var m chat.Message
+	require.NoError(t, json.Unmarshal(body, &m))
+	require.Empty(t, m.LinkPreviews)
+
+	// превью появляются асинхронно, ждем их в истории чата
+	waitPreviews := func(msgID int64) []chat.LinkPreview {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			status, body := doJSON(t, http.MethodGet, msgURL, nil)
+			require.Equal(t, http.StatusOK, status)
+			var page struct {
+				Messages []chat.Message `json:"messages"`
+			}
+			require.NoError(t, json.Unmarshal(body, &page))
+			for _, m := range page.Messages {
+				if m.ID == msgID && len(m.LinkPreviews) > 0 {
+					return m.LinkPreviews
+				}
+			}
+			require.True(t, time.Now().Before(deadline), "link preview did not appear")
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	require.Equal(t, []chat.LinkPreview{{
+		URL:         link,
+		Title:       "Статья",
+		Description: "Описание статьи",
+		ImageURL:    page.URL + "/cover.png",
+	}}, waitPreviews(m.ID))
+
+	// сообщения из пачки тоже получают превью
+	batchLink := page.URL + "/post?id=2"
+	status, body = doJSON(t, http.MethodPost, msgURL+":batch", map[string]any{
+		"messages": []map[string]any{{"text": "без ссылок"}, {"text": "и еще " + batchLink}},
+	})
+	require.Equal(t, http.StatusOK, status)
+	var batch struct {
+		Results []struct {
+			Message chat.Message `json:"message"`
+		} `json:"results"`
+	}
+	require.NoError(t, json.Unmarshal(body, &batch))
+	require.Len(t, batch.Results, 2)
+	previews := waitPreviews(batch.Results[1].Message.ID)
+	require.Len(t, previews, 1)
+	require.Equal(t, batchLink, previews[0].URL)
+	require.Equal(t, "Статья", previews[0].Title)
+
+	// правка текста заменяет превью ссылками нового текста, без ссылок превью пропадают
+	editURL := fmt.Sprintf("%s/%d", msgURL, m.ID)
+	editedLink := page.URL + "/post?id=3"
+	status, body = doJSON(t, http.MethodPatch, editURL, map[string]any{"text": "теперь " + editedLink})
+	require.Equal(t, http.StatusOK, status)
+	var edited chat.Message
+	require.NoError(t, json.Unmarshal(body, &edited))
+	require.Empty(t, edited.LinkPreviews)
+	previews = waitPreviews(m.ID)
+	require.Len(t, previews, 1)
+	require.Equal(t, editedLink, previews[0].URL)
+
+	status, _ = doJSON(t, http.MethodPatch, editURL, map[string]any{"text": "ссылку убрал"})
+	require.Equal(t, http.StatusOK, status)
+	status, body = doJSON(t, http.MethodGet, msgURL, nil)
+	require.Equal(t, http.StatusOK, status)
+	var history struct {
+		Messages []chat.Message `json:"messages"`
+	}
+	require.NoError(t, json.Unmarshal(body, &history))
+	for _, hm := range history.Messages {
+		if hm.ID == m.ID {
+			require.Empty(t, hm.LinkPreviews)
+		}
+	}
+}
+
 // Вспомогательные функции для тестов
+
+// Создаем чат через API и возвращаем его id
+func createChat(t *testing.T, baseURL, title string) int64 {
+	t.Helper()
+
+	var resp struct {
+		ID int64 `json:"id"`
+	}
+	status, body := doJSON(t, http.MethodPost, baseURL+"/chats/", map[string]any{"title": title})
+	require.Equal(t, http.StatusCreated, status)
+	require.NoError(t, json.Unmarshal(body, &resp))
+	return resp.ID
+}
+
+// Отправляем сообщение через API и возвращаем его id
+func createMessage(t *testing.T, baseURL string, chatID int64, text string) int64 {
+	t.Helper()
+
+	var resp struct {
+		ID int64 `json:"id"`
+	}
+	status, body := doJSON(t, http.MethodPost, fmt.Sprintf("%s/chats/%d/messages/", baseURL, chatID), map[string]any{"text": text})
+	require.Equal(t, http.StatusCreated, status)
+	require.NoError(t, json.Unmarshal(body, &resp))
+	return resp.ID
+}
+
 // поднимаем HTTP-сервер для тестов
 func startTestServer(t *testing.T) (*httptest.Server, *sql.DB) {
 	t.Helper()
@@ -122,41 +1564,107 @@ func startTestServer(t *testing.T) (*httptest.Server, *sql.DB) {
 
 	// Собираем приложение
 	repo := chat.NewRepo(gdb)
-	svc := chat.NewService(repo)
+	testBlobDir = t.TempDir()
+	blobs, err := blob.NewFS(testBlobDir)
+	require.NoError(t, err)
+	svc := chat.NewService(repo,
+		chat.WithBroker(realtime.NewHub(16)),
+		chat.WithPinLimit(testPinLimit),
+		chat.WithPresence(realtime.NewPresence()),
+		chat.WithBlobStore(blobs),
+		chat.WithAttachmentMaxBytes(testAttachmentMax),
+		chat.WithThumbnailer(thumbnail.New(testThumbnailSide)),
+		// страницы для превью ссылок отдает локальный httptest, поэтому внутренние адреса разрешены
+		chat.WithUnfurler(unfurl.New(unfurl.Config{AllowPrivate: true})),
+	)
+	workersCtx, stopWorkers := context.WithCancel(ctx)
+	t.Cleanup(stopWorkers)
+	go svc.RunThumbnailWorkers(workersCtx, 2, log)
+	go svc.RunUnfurlWorkers(workersCtx, 2, log)
 	api := httpapi.NewAPI(svc)
 	router := httpapi.NewRouter(api)
 
 	// Middleware
+	verifier, err := httpapi.NewTokenVerifier(testSecret, nil)
+	require.NoError(t, err)
 	handler := httpapi.RecoverMiddleware(log, router)
+	handler = httpapi.IdempotencyMiddleware(storage.NewIdempotencyStore(gdb), time.Hour, handler)
+	handler = httpapi.AuthMiddleware(verifier, handler)
 
 	// закрываем sqlDB после завершения теста
 	t.Cleanup(func() { _ = sqlDB.Close() })
 
+	// по умолчанию запросы идут от имени отдельного тестового пользователя
+	testToken = tokenFor(t, createUser(t, sqlDB, "tester"))
+
 	return httptest.NewServer(handler), sqlDB
 }
 
 // Очищаем таблицы перед тестом
 func cleanDB(t *testing.T, db *sql.DB) {
 	t.Helper()
-	_, err := db.Exec(`TRUNCATE TABLE messages, chats RESTART IDENTITY CASCADE;`)
+	_, err := db.Exec(`TRUNCATE TABLE messages, chats, users, idempotency_keys RESTART IDENTITY CASCADE;`)
+	require.NoError(t, err)
+}
+
+// Секрет HS256 тестового сервера, токен пользователя по умолчанию и каталог файлов вложений
+var (
+	testSecret  = []byte("test-secret")
+	testToken   string
+	testBlobDir string
+)
+
+// Создаем пользователя прямо в БД, через API это требует токена
+func createUser(t *testing.T, db *sql.DB, name string) int64 {
+	t.Helper()
+
+	var id int64
+	err := db.QueryRowContext(context.Background(), `INSERT INTO users (name) VALUES ($1) RETURNING id`, name).Scan(&id)
 	require.NoError(t, err)
+	return id
+}
+
+// Подписываем HS256 токен пользователя на час
+func tokenFor(t *testing.T, userID int64) string {
+	t.Helper()
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Subject:   strconv.FormatInt(userID, 10),
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}).SignedString(testSecret)
+	require.NoError(t, err)
+	return token
 }
 
 // Хелпер для JSON запросов
 func doJSON(t *testing.T, method, url string, payload any) (int, []byte) {
 	t.Helper()
 
+	return doJSONAs(t, testToken, method, url, payload)
+}
+
+// Хелпер для JSON запросов от имени конкретного пользователя
+func doJSONAs(t *testing.T, token, method, url string, payload any) (int, []byte) {
+	t.Helper()
+
 	b, err := json.Marshal(payload)
 	require.NoError(t, err)
 
-	// вызываем doRaw и возвращаем HTTP status code и тело ответа в массиве байт
-	return doRaw(t, method, url, b)
+	// вызываем doRawAs и возвращаем HTTP status code и тело ответа в массиве байт
+	return doRawAs(t, token, method, url, b)
 }
 
 // Отправляем HTTP-запрос на httptest.Server
 func doRaw(t *testing.T, method, url string, body []byte) (int, []byte) {
 	t.Helper()
 
+	return doRawAs(t, testToken, method, url, body)
+}
+
+// Отправляем HTTP-запрос на httptest.Server от имени пользователя с токеном token, пустой токен значит без авторизации
+func doRawAs(t *testing.T, token, method, url string, body []byte) (int, []byte) {
+	t.Helper()
+
 	// превращаем []byte в reader
 	var rbody *bytes.Reader
 	if body == nil {
@@ -173,6 +1681,9 @@ func doRaw(t *testing.T, method, url string, body []byte) (int, []byte) {
 	if body != nil {
 		req.Header.Set("Content-Type", "application/json")
 	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
 
 	// Выполняем запрос
 	resp, err := http.DefaultClient.Do(req)
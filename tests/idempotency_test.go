@@ -0,0 +1,175 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"hitalent/internal/chat"
+	"hitalent/internal/httpapi"
+	"hitalent/internal/idempotency"
+	"hitalent/internal/storage"
+)
+
+// memIdempotencyStore хранилище ключей в памяти для теста без БД, lease это номер занятия ключа
+type memIdempotencyStore struct {
+	mu     sync.Mutex
+	recs   map[string]*idempotency.Record
+	leases map[string]string
+	next   int
+}
+
+func (s *memIdempotencyStore) Reserve(_ context.Context, _ int64, key, hash string, _ time.Duration) (string, *idempotency.Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rec, ok := s.recs[key]; ok {
+		cp := *rec
+		return "", &cp, nil
+	}
+	s.next++
+	lease := strconv.Itoa(s.next)
+	s.recs[key] = &idempotency.Record{RequestHash: hash}
+	s.leases[key] = lease
+	return lease, nil, nil
+}
+
+func (s *memIdempotencyStore) Complete(_ context.Context, _ int64, key, lease string, rec idempotency.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.leases[key] == lease && s.recs[key].Status == 0 {
+		s.recs[key] = &rec
+	}
+	return nil
+}
+
+func (s *memIdempotencyStore) Release(_ context.Context, _ int64, key, lease string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.leases[key] == lease && s.recs[key].Status == 0 {
+		delete(s.recs, key)
+		delete(s.leases, key)
+	}
+	return nil
+}
+
+// Проверка IdempotencyMiddleware без БД: повтор, другой запрос с тем же ключом, 5xx не сохраняется
+func TestIdempotencyMiddleware(t *testing.T) {
+
+	calls := 0
+	fail := false
+	store := &memIdempotencyStore{recs: map[string]*idempotency.Record{}, leases: map[string]string{}}
+	handler := httpapi.IdempotencyMiddleware(store, time.Hour,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if fail {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"n":1}`))
+		}))
+
+	callPath := func(path, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req = req.WithContext(chat.WithUserID(req.Context(), 1))
+		req.Header.Set("Idempotency-Key", key)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	call := func(key, body string) *httptest.ResponseRecorder {
+		return callPath("/chats", key, body)
+	}
+
+	rec := call("a", `{"title":"x"}`)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	// повтор отдает сохраненный ответ без вызова обработчика
+	rec = call("a", `{"title":"x"}`)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	require.Equal(t, `{"n":1}`, rec.Body.String())
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	require.Equal(t, "true", rec.Header().Get("Idempotent-Replayed"))
+	require.Equal(t, 1, calls)
+
+	// тот же ключ с другим телом
+	rec = call("a", `{"title":"y"}`)
+	require.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	require.Equal(t, 1, calls)
+
+	// 5xx не сохраняется, повтор снова доходит до обработчика
+	fail = true
+	rec = call("b", `{"title":"x"}`)
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+	fail = false
+	rec = call("b", `{"title":"x"}`)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	require.Equal(t, 3, calls)
+
+	// ключ действует и на сообщения, а на другие POST не действует вовсе
+	rec = callPath("/chats/7/messages/", "m", `{"text":"x"}`)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	rec = callPath("/chats/7/messages/", "m", `{"text":"x"}`)
+	require.Equal(t, "true", rec.Header().Get("Idempotent-Replayed"))
+	require.Equal(t, 4, calls)
+	for i := 0; i < 2; i++ {
+		rec = callPath("/chats/7/messages:batch", "batch", `{"messages":[]}`)
+		require.Empty(t, rec.Header().Get("Idempotent-Replayed"))
+	}
+	require.Equal(t, 6, calls)
+	require.NotContains(t, store.recs, "batch")
+}
+
+// Проверка IdempotencyStore: ключ, брошенный незавершенным дольше аренды, повтор занимает заново
+func TestIdempotencyStore_StaleReservation(t *testing.T) {
+
+	ctx := context.Background()
+	gdb, sqlDB, err := storage.OpenPostgres(ctx)
+	require.NoError(t, err)
+	defer func() { _ = sqlDB.Close() }()
+	cleanDB(t, sqlDB)
+
+	store := storage.NewIdempotencyStore(gdb)
+	first, _, err := store.Reserve(ctx, 1, "crashed", "h1", time.Hour)
+	require.NoError(t, err)
+	require.NotEmpty(t, first)
+
+	// пока аренда не вышла, повтор видит запрос в работе
+	lease, rec, err := store.Reserve(ctx, 1, "crashed", "h1", time.Hour)
+	require.NoError(t, err)
+	require.Empty(t, lease)
+	require.Equal(t, 0, rec.Status)
+
+	// запрос завис или упал, не освободив ключ: через аренду повтор занимает его с новым lease
+	_, err = sqlDB.Exec(`UPDATE idempotency_keys SET created_at = NOW() - INTERVAL '5 minutes' WHERE key = 'crashed'`)
+	require.NoError(t, err)
+	retry, _, err := store.Reserve(ctx, 1, "crashed", "h1", time.Hour)
+	require.NoError(t, err)
+	require.NotEmpty(t, retry)
+	require.NotEqual(t, first, retry)
+
+	// исходный запрос со старым lease не освобождает и не завершает чужое занятие
+	require.NoError(t, store.Release(ctx, 1, "crashed", first))
+	require.NoError(t, store.Complete(ctx, 1, "crashed", first, idempotency.Record{RequestHash: "h1", Status: http.StatusConflict, Body: []byte(`{}`)}))
+	lease, rec, err = store.Reserve(ctx, 1, "crashed", "h1", time.Hour)
+	require.NoError(t, err)
+	require.Empty(t, lease)
+	require.Equal(t, 0, rec.Status)
+
+	// завершенный ключ аренда не трогает
+	require.NoError(t, store.Complete(ctx, 1, "crashed", retry, idempotency.Record{RequestHash: "h1", Status: http.StatusCreated, Body: []byte(`{}`)}))
+	_, err = sqlDB.Exec(`UPDATE idempotency_keys SET created_at = NOW() - INTERVAL '5 minutes' WHERE key = 'crashed'`)
+	require.NoError(t, err)
+	lease, rec, err = store.Reserve(ctx, 1, "crashed", "h1", time.Hour)
+	require.NoError(t, err)
+	require.Empty(t, lease)
+	require.Equal(t, http.StatusCreated, rec.Status)
+}
@@ -0,0 +1,422 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+
+	"hitalent/internal/chat"
+	"hitalent/internal/realtime"
+	"hitalent/internal/storage"
+)
+
+// Проверка хаба без БД: события доходят только подписчикам своего чата
+func TestHub_PublishToChatSubscribers(t *testing.T) {
+
+	hub := realtime.NewHub(4)
+	sub := hub.Subscribe(1)
+	other := hub.Subscribe(2)
+	defer sub.Close()
+	defer other.Close()
+
+	hub.Publish(chat.Event{Type: chat.EventMessageCreated, ChatID: 1, MessageID: 10})
+
+	select {
+	case ev := <-sub.Events():
+		require.Equal(t, int64(10), ev.MessageID)
+	case <-time.After(time.Second):
+		t.Fatal("event not delivered")
+	}
+	select {
+	case ev := <-other.Events():
+		t.Fatalf("unexpected event %+v", ev)
+	default:
+	}
+}
+
+// Медленного подписчика хаб отключает: канал закрывается, остальные продолжают получать события
+func TestHub_DropsSlowConsumer(t *testing.T) {
+
+	hub := realtime.NewHub(2)
+	slow := hub.Subscribe(1)
+	fast := hub.Subscribe(1)
+	defer fast.Close()
+
+	for i := int64(1); i <= 3; i++ {
+		hub.Publish(chat.Event{Type: chat.EventMessageCreated, ChatID: 1, MessageID: i})
+		<-fast.Events()
+	}
+
+	// в буфере два события, дальше канал закрыт
+	<-slow.Events()
+	<-slow.Events()
+	_, ok := <-slow.Events()
+	require.False(t, ok)
+
+	// повторное закрытие безопасно
+	slow.Close()
+}
+
+// Проверка GET /chats/{id}/ws: новое сообщение приходит подписчику, чужой чат не пускает
+func TestChatAPI_WebSocket(t *testing.T) {
+
+	srv, db := startTestServer(t)
+	defer srv.Close()
+
+	chatID := createChat(t, srv.URL, "live")
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + fmt.Sprintf("/chats/%d/ws", chatID)
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+testToken)
+	conn, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	defer func() { _ = conn.Close() }()
+
+	msgID := createMessage(t, srv.URL, chatID, "ping")
+
+	var ev chat.Event
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	require.NoError(t, conn.ReadJSON(&ev))
+	require.Equal(t, chat.EventMessageCreated, ev.Type)
+	require.Equal(t, msgID, ev.MessageID)
+	require.NotNil(t, ev.Message)
+	require.Equal(t, "ping", ev.Message.Text)
+
+	// токен через query тоже принимается, но не участнику вернется 403 до апгрейда
+	strangerID := createUser(t, db, "stranger")
+	stranger := tokenFor(t, strangerID)
+	_, resp, err = websocket.DefaultDialer.Dial(wsURL+"?access_token="+stranger, nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// после удаления из чата соединение участника закрывается
+	status, _ := doJSON(t, http.MethodPost, fmt.Sprintf("%s/chats/%d/members", srv.URL, chatID), map[string]any{"user_id": strangerID})
+	require.Equal(t, http.StatusCreated, status)
+	member, _, err := websocket.DefaultDialer.Dial(wsURL+"?access_token="+stranger, nil)
+	require.NoError(t, err)
+	defer func() { _ = member.Close() }()
+
+	status, _ = doRaw(t, http.MethodDelete, fmt.Sprintf("%s/chats/%d/members/%d", srv.URL, chatID, strangerID), nil)
+	require.Equal(t, http.StatusNoContent, status)
+
+	require.NoError(t, member.SetReadDeadline(time.Now().Add(5*time.Second)))
+	require.NoError(t, member.ReadJSON(&ev))
+	require.Equal(t, chat.EventMemberRemoved, ev.Type)
+	require.Equal(t, strangerID, ev.UserID)
+	_, _, err = member.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), "err: %v", err)
+}
+
+func TestChatAPI_EventStreamResume(t *testing.T) {
+
+	srv, _ := startTestServer(t)
+	defer srv.Close()
+
+	chatID := createChat(t, srv.URL, "sse")
+	first := createMessage(t, srv.URL, chatID, "one")
+	second := createMessage(t, srv.URL, chatID, "two")
+
+	// переподключение с Last-Event-ID: сначала приходит пропущенное сообщение, потом новые
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/chats/%d/events", srv.URL, chatID), nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	req.Header.Set("Last-Event-ID", fmt.Sprint(first))
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, resp.Header.Get("Content-Type"), "text/event-stream")
+
+	next := readSSE(t, resp)
+	ev, id := next()
+	require.Equal(t, chat.EventMessageCreated, ev.Type)
+	require.Equal(t, second, ev.MessageID)
+	require.Equal(t, fmt.Sprint(second), id)
+
+	third := createMessage(t, srv.URL, chatID, "three")
+	ev, id = next()
+	require.Equal(t, third, ev.MessageID)
+	require.Equal(t, fmt.Sprint(third), id)
+
+	status, _ := doRaw(t, http.MethodDelete, fmt.Sprintf("%s/chats/%d/messages/%d", srv.URL, chatID, third), nil)
+	require.Equal(t, http.StatusNoContent, status)
+	ev, id = next()
+	require.Equal(t, chat.EventMessageDeleted, ev.Type)
+	require.Equal(t, third, ev.MessageID)
+	require.Empty(t, id)
+}
+
+// Сообщение с меньшим id может закоммититься позже большего: поток не должен его пропускать
+func TestChatAPI_EventStreamOutOfOrderIDs(t *testing.T) {
+
+	srv, db := startTestServer(t)
+	defer srv.Close()
+
+	chatID := createChat(t, srv.URL, "sse order")
+	first := createMessage(t, srv.URL, chatID, "one")
+	second := createMessage(t, srv.URL, chatID, "two")
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/chats/%d/events", srv.URL, chatID), nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	req.Header.Set("Last-Event-ID", fmt.Sprint(first))
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	next := readSSE(t, resp)
+	ev, _ := next()
+	require.Equal(t, second, ev.MessageID)
+
+	// сдвигаем последовательность вперед и назад: сообщение с большим id публикуется раньше меньшего
+	setSeq := func(v int64) {
+		_, err := db.Exec(`SELECT setval(pg_get_serial_sequence('messages', 'id'), $1)`, v)
+		require.NoError(t, err)
+	}
+	setSeq(second + 10)
+	high := createMessage(t, srv.URL, chatID, "high")
+	setSeq(second)
+	low := createMessage(t, srv.URL, chatID, "low")
+	require.Less(t, low, high)
+
+	ev, id := next()
+	require.Equal(t, high, ev.MessageID)
+	require.Equal(t, fmt.Sprint(high), id)
+	ev, id = next()
+	require.Equal(t, low, ev.MessageID)
+	require.Equal(t, fmt.Sprint(low), id)
+}
+
+// readSSE читаем поток событий в фоне, next возвращает очередное событие и его id
+func readSSE(t *testing.T, resp *http.Response) func() (chat.Event, string) {
+	t.Helper()
+
+	events := make(chan chat.Event, 8)
+	ids := make(chan string, 8)
+	go func() {
+		sc := bufio.NewScanner(resp.Body)
+		var id string
+		for sc.Scan() {
+			line := sc.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				var ev chat.Event
+				if json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev) == nil {
+					ids <- id
+					events <- ev
+				}
+				id = ""
+			}
+		}
+	}()
+
+	return func() (chat.Event, string) {
+		select {
+		case ev := <-events:
+			return ev, <-ids
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+		}
+		return chat.Event{}, ""
+	}
+}
+
+// Две реплики на одной базе: сообщение, записанное через A, доходит до подписчиков B через LISTEN/NOTIFY
+func TestPGNotifier_FanOutAcrossReplicas(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	gdb, sqlDB, err := storage.OpenPostgres(ctx)
+	require.NoError(t, err)
+	defer func() { _ = sqlDB.Close() }()
+	cleanDB(t, sqlDB)
+
+	log := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelWarn}))
+
+	notifierA := storage.NewPGNotifier(storage.DSN(), log)
+	svcA := chat.NewService(chat.NewRepo(gdb, chat.WithTxNotifier(notifierA)), chat.WithBroker(realtime.NewHub(16)))
+
+	hubB := realtime.NewHub(16)
+	notifierB := storage.NewPGNotifier(storage.DSN(), log)
+	presenceB := realtime.NewPresence()
+	svcB := chat.NewService(chat.NewRepo(gdb, chat.WithTxNotifier(notifierB)), chat.WithBroker(hubB), chat.WithPresence(presenceB))
+	go notifierB.Listen(ctx, func(ctx context.Context, ev chat.Event) {
+		_ = svcB.Relay(ctx, ev)
+	})
+
+	aliceID := createUser(t, sqlDB, "alice")
+	userCtx := chat.WithUserID(ctx, aliceID)
+	c, err := svcA.CreateChat(userCtx, "fan-out")
+	require.NoError(t, err)
+
+	sub := hubB.Subscribe(c.ID)
+	defer sub.Close()
+
+	// слушатель B подключается асинхронно, поэтому пишем, пока событие не дойдет
+	sent := map[int64]bool{}
+	var msgID int64
+	deadline := time.After(10 * time.Second)
+	for msgID == 0 {
+		m, _, err := svcA.CreateMessage(userCtx, c.ID, chat.NewMessage{Text: "hello"})
+		require.NoError(t, err)
+		sent[m.ID] = true
+
+		select {
+		case ev := <-sub.Events():
+			require.Equal(t, chat.EventMessageCreated, ev.Type)
+			require.True(t, sent[ev.MessageID])
+			require.NotNil(t, ev.Message)
+			require.Equal(t, "hello", ev.Message.Text)
+			require.NotNil(t, ev.Message.Author)
+			require.Equal(t, "alice", ev.Message.Author.Name)
+			msgID = ev.MessageID
+		case <-time.After(200 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("event did not reach the other replica")
+		}
+	}
+
+	// правки, набор текста, удаления и удаление чата тоже доходят до другой реплики, остальные created пропускаем
+	next := func(typ string) chat.Event {
+		t.Helper()
+		for {
+			select {
+			case ev := <-sub.Events():
+				if ev.Type == chat.EventMessageCreated {
+					continue
+				}
+				require.Equal(t, typ, ev.Type)
+				return ev
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s did not reach the other replica", typ)
+			}
+		}
+	}
+
+	_, err = svcA.EditMessage(userCtx, c.ID, msgID, "edited")
+	require.NoError(t, err)
+	ev := next(chat.EventMessageUpdated)
+	require.Equal(t, msgID, ev.MessageID)
+	require.NotNil(t, ev.Message)
+	require.Equal(t, "edited", ev.Message.Text)
+
+	require.NoError(t, svcA.Typing(userCtx, c.ID))
+	ev = next(chat.EventTyping)
+	require.Equal(t, aliceID, ev.UserID)
+	require.Equal(t, []chat.Presence{{UserID: aliceID, Online: true, Typing: true}}, presenceB.List(c.ID))
+
+	require.NoError(t, svcA.DeleteMessage(userCtx, c.ID, msgID))
+	ev = next(chat.EventMessageDeleted)
+	require.Equal(t, msgID, ev.MessageID)
+
+	require.NoError(t, svcA.DeleteChat(userCtx, c.ID))
+	ev = next(chat.EventChatDeleted)
+	require.Equal(t, c.ID, ev.ChatID)
+}
+
+// Хранилище присутствия без БД: typing истекает раньше online, пустые записи пропадают
+func TestPresence_TTL(t *testing.T) {
+
+	p := realtime.NewPresence()
+	p.Touch(1, 10, chat.PresenceOnline, time.Hour)
+	p.Touch(1, 10, chat.PresenceTyping, 50*time.Millisecond)
+	p.Touch(1, 20, chat.PresenceTyping, 50*time.Millisecond)
+	p.Touch(2, 30, chat.PresenceOnline, time.Hour)
+
+	require.Equal(t, []chat.Presence{
+		{UserID: 10, Online: true, Typing: true},
+		{UserID: 20, Typing: true},
+	}, p.List(1))
+
+	// более короткий ttl не сокращает уже выставленный срок
+	p.Touch(1, 10, chat.PresenceOnline, time.Millisecond)
+
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, []chat.Presence{{UserID: 10, Online: true}}, p.List(1))
+	require.Len(t, p.List(2), 1)
+	require.Empty(t, p.List(3))
+}
+
+// Sweep вычищает истекшие записи и в чатах, к которым больше никто не обращается
+func TestPresence_Sweep(t *testing.T) {
+
+	p := realtime.NewPresence()
+	p.Touch(1, 10, chat.PresenceTyping, 20*time.Millisecond)
+	p.Touch(2, 20, chat.PresenceOnline, 20*time.Millisecond)
+	p.Touch(3, 30, chat.PresenceOnline, time.Hour)
+	require.Equal(t, 3, p.Len())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Sweep(ctx, 10*time.Millisecond)
+
+	require.Eventually(t, func() bool { return p.Len() == 1 }, time.Second, 10*time.Millisecond)
+	require.Len(t, p.List(3), 1)
+}
+
+// POST /chats/{id}/typing доходит до подписчиков, GET /chats/{id}/presence показывает онлайн и печатающих
+func TestChatAPI_TypingAndPresence(t *testing.T) {
+
+	srv, db := startTestServer(t)
+	defer srv.Close()
+
+	chatID := createChat(t, srv.URL, "typing")
+	readerID := createUser(t, db, "reader")
+	status, _ := doJSON(t, http.MethodPost, fmt.Sprintf("%s/chats/%d/members", srv.URL, chatID), map[string]any{"user_id": readerID})
+	require.Equal(t, http.StatusCreated, status)
+	reader := tokenFor(t, readerID)
+
+	// reader подключается по WebSocket и становится онлайн
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + fmt.Sprintf("/chats/%d/ws?access_token=%s", chatID, reader)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	status, _ = doRaw(t, http.MethodPost, fmt.Sprintf("%s/chats/%d/typing", srv.URL, chatID), nil)
+	require.Equal(t, http.StatusNoContent, status)
+
+	var ev chat.Event
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	require.NoError(t, conn.ReadJSON(&ev))
+	require.Equal(t, chat.EventTyping, ev.Type)
+	require.Equal(t, chatID, ev.ChatID)
+	require.NotZero(t, ev.UserID)
+	require.NotEqual(t, readerID, ev.UserID)
+
+	status, body := doJSONAs(t, reader, http.MethodGet, fmt.Sprintf("%s/chats/%d/presence", srv.URL, chatID), nil)
+	require.Equal(t, http.StatusOK, status)
+	var resp struct {
+		Presence []chat.Presence `json:"presence"`
+	}
+	require.NoError(t, json.Unmarshal(body, &resp))
+	byName := map[string]chat.Presence{}
+	for _, p := range resp.Presence {
+		byName[p.Name] = p
+	}
+	require.Len(t, byName, 2)
+	require.Equal(t, chat.Presence{UserID: ev.UserID, Name: "tester", Online: true, Typing: true}, byName["tester"])
+	require.Equal(t, chat.Presence{UserID: readerID, Name: "reader", Online: true}, byName["reader"])
+
+	// не участник не видит присутствие и не может печатать
+	stranger := tokenFor(t, createUser(t, db, "stranger"))
+	status, _ = doJSONAs(t, stranger, http.MethodGet, fmt.Sprintf("%s/chats/%d/presence", srv.URL, chatID), nil)
+	require.Equal(t, http.StatusForbidden, status)
+	status, _ = doRawAs(t, stranger, http.MethodPost, fmt.Sprintf("%s/chats/%d/typing", srv.URL, chatID), nil)
+	require.Equal(t, http.StatusForbidden, status)
+}
@@ -0,0 +1,60 @@
+package tests
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"hitalent/internal/thumbnail"
+)
+
+// Превью без БД: пропорции, предел стороны, формат результата и отказ на не-картинках
+func TestThumbnail_Maker(t *testing.T) {
+
+	src := image.NewRGBA(image.Rect(0, 0, 800, 200))
+	for x := 0; x < 800; x++ {
+		src.Set(x, x%200, color.RGBA{R: 255, A: 255})
+	}
+	maker := thumbnail.New(100)
+
+	cases := []struct {
+		name   string
+		encode func(*bytes.Buffer) error
+		ctype  string
+	}{
+		{"png", func(b *bytes.Buffer) error { return png.Encode(b, src) }, "image/png"},
+		{"jpeg", func(b *bytes.Buffer) error { return jpeg.Encode(b, src, nil) }, "image/jpeg"},
+		{"gif", func(b *bytes.Buffer) error { return gif.Encode(b, src, nil) }, "image/png"},
+	}
+	for _, tc := range cases {
+		var in bytes.Buffer
+		require.NoError(t, tc.encode(&in), tc.name)
+
+		data, ctype, err := maker.Thumbnail(&in)
+		require.NoError(t, err, tc.name)
+		require.Equal(t, tc.ctype, ctype, tc.name)
+
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+		require.NoError(t, err, tc.name)
+		require.Equal(t, 100, cfg.Width, tc.name)
+		require.Equal(t, 25, cfg.Height, tc.name)
+	}
+
+	// маленькая картинка не увеличивается
+	var small bytes.Buffer
+	require.NoError(t, png.Encode(&small, image.NewGray(image.Rect(0, 0, 10, 30))))
+	data, _, err := maker.Thumbnail(&small)
+	require.NoError(t, err)
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, image.Config{ColorModel: cfg.ColorModel, Width: 10, Height: 30}, cfg)
+
+	_, _, err = maker.Thumbnail(bytes.NewReader([]byte("not an image at all")))
+	require.ErrorIs(t, err, thumbnail.ErrUnsupported)
+}